@@ -0,0 +1,396 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// DefaultLimit is the page size used when no limit is requested.
+	DefaultLimit = 100
+	// MaxLimit is the largest page size that may be requested.
+	MaxLimit = 1000
+)
+
+// Session is a stored session along with its computed times and durations.
+// The user's email is never included, and the user is left empty if user data
+// is disabled.
+type Session struct {
+	payload.Payload
+	StartTime       time.Time  `json:"startTime"`
+	LastSeen        time.Time  `json:"lastSeen"`
+	EndTime         *time.Time `json:"endTime,omitempty"`
+	Active          bool       `json:"active"`
+	Duration        float64    `json:"durationSeconds"`
+	FocusedDuration float64    `json:"focusedDurationSeconds"`
+}
+
+// SessionPage is the response body of /api/sessions.
+type SessionPage struct {
+	Total    int       `json:"total"`
+	Offset   int       `json:"offset"`
+	Limit    int       `json:"limit"`
+	Sessions []Session `json:"sessions"`
+}
+
+// DashboardStats is the response body of /api/dashboards/{uid}/stats.
+type DashboardStats struct {
+	UID             string     `json:"uid"`
+	Name            string     `json:"name"`
+	Sessions        int        `json:"sessions"`
+	ActiveSessions  int        `json:"activeSessions"`
+	Users           int        `json:"users"`
+	Duration        float64    `json:"durationSeconds"`
+	FocusedDuration float64    `json:"focusedDurationSeconds"`
+	FirstSeen       *time.Time `json:"firstSeen,omitempty"`
+	LastSeen        *time.Time `json:"lastSeen,omitempty"`
+}
+
+// UserActivity is the response body of /api/users/{login}/activity.
+type UserActivity struct {
+	Login           string              `json:"login"`
+	Sessions        int                 `json:"sessions"`
+	Duration        float64             `json:"durationSeconds"`
+	FocusedDuration float64             `json:"focusedDurationSeconds"`
+	LastSeen        *time.Time          `json:"lastSeen,omitempty"`
+	Dashboards      []DashboardActivity `json:"dashboards"`
+}
+
+// DashboardActivity is a user's activity on a single dashboard.
+type DashboardActivity struct {
+	UID             string    `json:"uid"`
+	Name            string    `json:"name"`
+	Sessions        int       `json:"sessions"`
+	Duration        float64   `json:"durationSeconds"`
+	FocusedDuration float64   `json:"focusedDurationSeconds"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// Handler serves a read-only JSON API for the sessions in the store.
+type Handler struct {
+	store    payload.SessionStore
+	timeout  time.Duration
+	userData bool
+	logger   log.Logger
+	mux      *http.ServeMux
+}
+
+// NewHandler creates a new Handler. The timeout is used to compute durations
+// and activity, as for the exporter. If userData is false, sessions are listed
+// without their user, and sessions cannot be selected by user.
+func NewHandler(store payload.SessionStore, timeout time.Duration, userData bool, logger log.Logger) *Handler {
+	h := &Handler{
+		store:    store,
+		timeout:  timeout,
+		userData: userData,
+		logger:   logger,
+		mux:      http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/api/sessions", h.sessions)
+	h.mux.HandleFunc("/api/dashboards/", h.dashboardStats)
+	if userData {
+		h.mux.HandleFunc("/api/users/", h.userActivity)
+	}
+
+	return h
+}
+
+// ServeHTTP serves all routes under /api/.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// filter selects sessions by dashboard, user and time. Sessions match the
+// time filter if they were seen at any point between from and to.
+type filter struct {
+	dashboard string
+	user      string
+	from      time.Time
+	to        time.Time
+}
+
+func (f filter) match(p payload.Payload) bool {
+	if f.dashboard != "" && p.Dashboard.UID != f.dashboard {
+		return false
+	}
+	if f.user != "" && p.User.Login != f.user {
+		return false
+	}
+	if !f.from.IsZero() && p.GetLastSeen().Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && p.GetStartTime().After(f.to) {
+		return false
+	}
+
+	return true
+}
+
+// sessions serves /api/sessions, with the most recently started sessions first.
+func (h *Handler) sessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	f, err := parseFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.dashboard = q.Get("dashboard")
+	f.user = q.Get("user")
+	if f.user != "" && !h.userData {
+		http.Error(w, "Filtering by user is disabled", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := parseInt(q, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseInt(q, "limit", DefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	sessions := find(h.store, f)
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].GetStartTime().After(sessions[j].GetStartTime())
+	})
+
+	page := SessionPage{
+		Total:    len(sessions),
+		Offset:   offset,
+		Limit:    limit,
+		Sessions: []Session{},
+	}
+	for i := offset; i < len(sessions) && i < offset+limit; i++ {
+		page.Sessions = append(page.Sessions, h.newSession(sessions[i]))
+	}
+
+	writeJSON(w, page, h.logger)
+}
+
+// dashboardStats serves /api/dashboards/{uid}/stats.
+func (h *Handler) dashboardStats(w http.ResponseWriter, r *http.Request) {
+	uid, ok := pathParam(r.URL.Path, "/api/dashboards/", "/stats")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.dashboard = uid
+
+	sessions := find(h.store, f)
+	if len(sessions) == 0 {
+		http.Error(w, "No sessions found for dashboard", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	stats := DashboardStats{UID: uid, Sessions: len(sessions)}
+	users := map[string]bool{}
+	for _, p := range sessions {
+		stats.Name = p.Dashboard.Name
+		users[p.User.Login] = true
+		if p.IsActive(now, h.timeout) {
+			stats.ActiveSessions++
+		}
+		stats.Duration += p.GetDuration(h.timeout).Seconds()
+		stats.FocusedDuration += p.GetFocusedDuration(h.timeout).Seconds()
+
+		if start := p.GetStartTime(); stats.FirstSeen == nil || start.Before(*stats.FirstSeen) {
+			stats.FirstSeen = &start
+		}
+		if lastSeen := p.GetLastSeen(); stats.LastSeen == nil || lastSeen.After(*stats.LastSeen) {
+			stats.LastSeen = &lastSeen
+		}
+	}
+	stats.Users = len(users)
+
+	writeJSON(w, stats, h.logger)
+}
+
+// userActivity serves /api/users/{login}/activity.
+func (h *Handler) userActivity(w http.ResponseWriter, r *http.Request) {
+	login, ok := pathParam(r.URL.Path, "/api/users/", "/activity")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.user = login
+
+	sessions := find(h.store, f)
+	if len(sessions) == 0 {
+		http.Error(w, "No sessions found for user", http.StatusNotFound)
+		return
+	}
+
+	activity := UserActivity{Login: login, Sessions: len(sessions)}
+	dashboards := map[string]*DashboardActivity{}
+	for _, p := range sessions {
+		duration := p.GetDuration(h.timeout).Seconds()
+		focused := p.GetFocusedDuration(h.timeout).Seconds()
+		lastSeen := p.GetLastSeen()
+
+		activity.Duration += duration
+		activity.FocusedDuration += focused
+		if activity.LastSeen == nil || lastSeen.After(*activity.LastSeen) {
+			activity.LastSeen = &lastSeen
+		}
+
+		d, ok := dashboards[p.Dashboard.UID]
+		if !ok {
+			d = &DashboardActivity{UID: p.Dashboard.UID}
+			dashboards[p.Dashboard.UID] = d
+		}
+		d.Name = p.Dashboard.Name
+		d.Sessions++
+		d.Duration += duration
+		d.FocusedDuration += focused
+		if lastSeen.After(d.LastSeen) {
+			d.LastSeen = lastSeen
+		}
+	}
+
+	for _, d := range dashboards {
+		activity.Dashboards = append(activity.Dashboards, *d)
+	}
+	sort.Slice(activity.Dashboards, func(i, j int) bool {
+		return activity.Dashboards[i].LastSeen.After(activity.Dashboards[j].LastSeen)
+	})
+
+	writeJSON(w, activity, h.logger)
+}
+
+// find returns all stored sessions matching the filter.
+func find(store payload.SessionStore, f filter) []payload.Payload {
+	var sessions []payload.Payload
+	store.Range(func(_ string, p payload.Payload) bool {
+		if f.match(p) {
+			sessions = append(sessions, p)
+		}
+		return true
+	})
+
+	return sessions
+}
+
+func (h *Handler) newSession(p payload.Payload) Session {
+	if h.userData {
+		p.User.Email = ""
+	} else {
+		p.User = payload.UserInfo{}
+	}
+
+	s := Session{
+		Payload:         p,
+		StartTime:       p.GetStartTime(),
+		LastSeen:        p.GetLastSeen(),
+		Active:          p.IsActive(time.Now(), h.timeout),
+		Duration:        p.GetDuration(h.timeout).Seconds(),
+		FocusedDuration: p.GetFocusedDuration(h.timeout).Seconds(),
+	}
+	if end := p.GetEndTime(); !end.IsZero() {
+		s.EndTime = &end
+	}
+
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to write response", "err", err)
+	}
+}
+
+// pathParam returns the single path segment between prefix and suffix.
+func pathParam(path string, prefix string, suffix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+
+	param := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+	if param == "" || strings.Contains(param, "/") {
+		return "", false
+	}
+
+	return param, true
+}
+
+func parseFilter(q url.Values) (filter, error) {
+	f := filter{}
+
+	var err error
+	f.from, err = parseTime(q, "from")
+	if err != nil {
+		return f, err
+	}
+	f.to, err = parseTime(q, "to")
+	return f, err
+}
+
+// parseTime parses a unix timestamp in seconds or an RFC 3339 time.
+func parseTime(q url.Values, key string) (time.Time, error) {
+	v := q.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("Invalid value for %s: %s", key, v)
+	}
+
+	return t, nil
+}
+
+func parseInt(q url.Values, key string, def int) (int, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("Invalid value for %s: %s", key, v)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,157 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/api"
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+type event struct {
+	uuid      string
+	dashboard string
+	login     string
+	eventType string
+	time      int
+}
+
+func newServer(t *testing.T, events []event, userData bool) *httptest.Server {
+	cache := cacher.NewCache(0, 0)
+	for _, e := range events {
+		request := payloadtest.GetPayload(t)
+		request.UUID = e.uuid
+		request.Dashboard.UID = e.dashboard
+		request.User.Login = e.login
+		request.Type = e.eventType
+		request.Time = e.time
+		payload.ProcessPayload(cache, request, logger)
+	}
+
+	return httptest.NewServer(api.NewHandler(cache, time.Duration(0), userData, logger))
+}
+
+func get(t *testing.T, url string, status int, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("Expected status %d for %s, got %d", status, url, resp.StatusCode)
+	}
+	if v == nil {
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var events = []event{
+	{"a", "dash-1", "alice", "start", 1000},
+	{"a", "dash-1", "alice", "end", 1600},
+	{"b", "dash-1", "bob", "start", 2000},
+	{"b", "dash-1", "bob", "end", 2300},
+	{"c", "dash-2", "alice", "start", 3000},
+	{"c", "dash-2", "alice", "end", 3060},
+}
+
+func TestSessions(t *testing.T) {
+	testserver := newServer(t, events, true)
+	defer testserver.Close()
+
+	page := api.SessionPage{}
+	get(t, testserver.URL+"/api/sessions?limit=2", http.StatusOK, &page)
+
+	if page.Total != 3 || len(page.Sessions) != 2 {
+		t.Fatalf("Expected 2 of 3 sessions, got %d of %d", len(page.Sessions), page.Total)
+	}
+	if page.Sessions[0].UUID != "c" || page.Sessions[1].UUID != "b" {
+		t.Errorf("Expected the most recent sessions first, got %s, %s", page.Sessions[0].UUID, page.Sessions[1].UUID)
+	}
+	if page.Sessions[0].Duration != 60 {
+		t.Errorf("Expected a duration of 60, got %f", page.Sessions[0].Duration)
+	}
+	if page.Sessions[0].User.Login != "alice" || page.Sessions[0].User.Email != "" {
+		t.Errorf("Expected the user without email, got %+v", page.Sessions[0].User)
+	}
+
+	page = api.SessionPage{}
+	get(t, testserver.URL+"/api/sessions?dashboard=dash-1&user=alice", http.StatusOK, &page)
+	if page.Total != 1 || page.Sessions[0].UUID != "a" {
+		t.Errorf("Expected only session a, got %+v", page)
+	}
+
+	page = api.SessionPage{}
+	get(t, testserver.URL+"/api/sessions?from=1700&to=2500", http.StatusOK, &page)
+	if page.Total != 1 || page.Sessions[0].UUID != "b" {
+		t.Errorf("Expected only session b, got %+v", page)
+	}
+
+	get(t, testserver.URL+"/api/sessions?from=yesterday", http.StatusBadRequest, nil)
+}
+
+func TestDashboardStats(t *testing.T) {
+	testserver := newServer(t, events, true)
+	defer testserver.Close()
+
+	stats := api.DashboardStats{}
+	get(t, testserver.URL+"/api/dashboards/dash-1/stats", http.StatusOK, &stats)
+
+	if stats.Sessions != 2 || stats.Users != 2 {
+		t.Errorf("Expected 2 sessions and 2 users, got %d and %d", stats.Sessions, stats.Users)
+	}
+	if stats.Duration != 900 {
+		t.Errorf("Expected a duration of 900, got %f", stats.Duration)
+	}
+	if stats.LastSeen == nil || stats.LastSeen.Unix() != 2300 {
+		t.Errorf("Expected last seen at 2300, got %v", stats.LastSeen)
+	}
+
+	get(t, testserver.URL+"/api/dashboards/unknown/stats", http.StatusNotFound, nil)
+}
+
+func TestUserActivity(t *testing.T) {
+	testserver := newServer(t, events, true)
+	defer testserver.Close()
+
+	activity := api.UserActivity{}
+	get(t, testserver.URL+"/api/users/alice/activity", http.StatusOK, &activity)
+
+	if activity.Sessions != 2 || activity.Duration != 660 {
+		t.Errorf("Expected 2 sessions with a duration of 660, got %d and %f", activity.Sessions, activity.Duration)
+	}
+	if len(activity.Dashboards) != 2 || activity.Dashboards[0].UID != "dash-2" {
+		t.Errorf("Expected dash-2 to be the most recent dashboard, got %+v", activity.Dashboards)
+	}
+}
+
+func TestUserDataDisabled(t *testing.T) {
+	testserver := newServer(t, events, false)
+	defer testserver.Close()
+
+	page := api.SessionPage{}
+	get(t, testserver.URL+"/api/sessions", http.StatusOK, &page)
+	for _, s := range page.Sessions {
+		if s.User != (payload.UserInfo{}) {
+			t.Errorf("Expected no user data, got %+v", s.User)
+		}
+	}
+
+	get(t, testserver.URL+"/api/sessions?user=alice", http.StatusBadRequest, nil)
+	get(t, testserver.URL+"/api/users/alice/activity", http.StatusNotFound, nil)
+}
@@ -0,0 +1,477 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+)
+
+// Targets offered by the Datasource. Time series are split by dashboard.
+const (
+	TargetSessions        = "sessions"
+	TargetActiveSessions  = "active_sessions"
+	TargetSessionDuration = "session_duration"
+	TargetTopUsers        = "top_users"
+	TargetDashboards      = "dashboards"
+	TargetSessionList     = "session_list"
+)
+
+// MaxDataPoints is the largest number of datapoints returned per time series.
+// Longer ranges are queried with a wider interval.
+const MaxDataPoints = 10000
+
+var targets = []string{
+	TargetSessions,
+	TargetActiveSessions,
+	TargetSessionDuration,
+	TargetTopUsers,
+	TargetDashboards,
+	TargetSessionList,
+}
+
+// Datasource implements the Grafana JSON datasource protocol, so the stored
+// sessions can be charted in Grafana directly.
+type Datasource struct {
+	store    payload.SessionStore
+	timeout  time.Duration
+	userData bool
+	logger   log.Logger
+	prefix   string
+}
+
+// NewDatasource creates a new Datasource, which serves its routes below prefix.
+// If userData is false, the top_users target and selecting sessions by user
+// are not available, and sessions are shown without their user.
+func NewDatasource(prefix string, store payload.SessionStore, timeout time.Duration, userData bool, logger log.Logger) *Datasource {
+	return &Datasource{
+		store:    store,
+		timeout:  timeout,
+		userData: userData,
+		logger:   logger,
+		prefix:   strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+// QueryRange is the time range of a query or annotation request.
+type QueryRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// QueryTarget is a single target of a query request. Data may select the
+// sessions of a single dashboard and/or user.
+type QueryTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+	Data   struct {
+		Dashboard string `json:"dashboard"`
+		User      string `json:"user"`
+	} `json:"data"`
+}
+
+// QueryRequest is the body of /query.
+type QueryRequest struct {
+	Range         QueryRange    `json:"range"`
+	IntervalMs    int64         `json:"intervalMs"`
+	MaxDataPoints int64         `json:"maxDataPoints"`
+	Targets       []QueryTarget `json:"targets"`
+}
+
+// TimeSeries is a query response for a time series target. Each datapoint is
+// a value and a unix timestamp in milliseconds.
+type TimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// Table is a query response for a table target.
+type Table struct {
+	Type    string          `json:"type"`
+	Columns []TableColumn   `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// TableColumn is a column of a Table.
+type TableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// AnnotationRequest is the body of /annotations. The annotation query may
+// hold a dashboard UID or user login to select sessions.
+type AnnotationRequest struct {
+	Range      QueryRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+// Annotation marks a session in an annotation response.
+type Annotation struct {
+	Time     int64    `json:"time"`
+	TimeEnd  int64    `json:"timeEnd"`
+	IsRegion bool     `json:"isRegion"`
+	Title    string   `json:"title"`
+	Text     string   `json:"text"`
+	Tags     []string `json:"tags"`
+}
+
+// ServeHTTP serves /, /search, /query and /annotations below the prefix.
+func (d *Datasource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, d.prefix) {
+	case "", "/":
+		// Used by Grafana to test the datasource.
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		writeJSON(w, d.targets(), d.logger)
+	case "/query":
+		d.query(w, r)
+	case "/annotations":
+		d.annotations(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *Datasource) query(w http.ResponseWriter, r *http.Request) {
+	req := QueryRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !req.Range.To.After(req.Range.From) {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+
+	if req.IntervalMs < 0 || req.MaxDataPoints < 0 {
+		http.Error(w, "Invalid interval or maxDataPoints", http.StatusBadRequest)
+		return
+	}
+
+	// The interval is widened if it would exceed the maximum number of points.
+	// As the first interval starts before the range, the range is divided
+	// into one interval less than the maximum.
+	maxPoints := int64(MaxDataPoints)
+	if req.MaxDataPoints > 0 && req.MaxDataPoints < maxPoints {
+		maxPoints = req.MaxDataPoints
+	}
+	if maxPoints < 2 {
+		maxPoints = 2
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval < time.Second {
+		interval = time.Second
+	}
+	span := req.Range.To.Sub(req.Range.From)
+	if min := (span + time.Duration(maxPoints-2)) / time.Duration(maxPoints-1); interval < min {
+		interval = min
+	}
+
+	resp := []interface{}{}
+	for _, t := range req.Targets {
+		if !d.userData && (t.Target == TargetTopUsers || t.Data.User != "") {
+			http.Error(w, "User data is disabled", http.StatusBadRequest)
+			return
+		}
+
+		sessions := find(d.store, filter{
+			dashboard: t.Data.Dashboard,
+			user:      t.Data.User,
+			from:      req.Range.From,
+			to:        req.Range.To,
+		})
+
+		switch t.Target {
+		case TargetSessions, TargetActiveSessions, TargetSessionDuration:
+			for _, ts := range d.timeSeries(t.Target, sessions, req.Range, interval) {
+				resp = append(resp, ts)
+			}
+		case TargetTopUsers:
+			resp = append(resp, d.topUsers(sessions))
+		case TargetDashboards:
+			resp = append(resp, d.dashboards(sessions))
+		case TargetSessionList:
+			resp = append(resp, d.sessionList(sessions))
+		default:
+			http.Error(w, fmt.Sprintf("Unknown target: %s", t.Target), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, resp, d.logger)
+}
+
+// timeSeries returns a series per dashboard, with a datapoint for each
+// interval. Sessions are counted, and their duration added, in the interval
+// they started in. Active sessions are counted in every interval they span.
+func (d *Datasource) timeSeries(target string, sessions []payload.Payload, r QueryRange, interval time.Duration) []TimeSeries {
+	from := r.From.Truncate(interval)
+	points := int(r.To.Sub(from)/interval) + 1
+
+	names := map[string]string{}
+	values := map[string][]float64{}
+	for _, p := range sessions {
+		v, ok := values[p.Dashboard.UID]
+		if !ok {
+			v = make([]float64, points)
+			values[p.Dashboard.UID] = v
+		}
+		names[p.Dashboard.UID] = p.Dashboard.Name
+
+		first := int(p.GetStartTime().Sub(from) / interval)
+		last := first
+		if target == TargetActiveSessions {
+			last = int(p.GetLastSeen().Sub(from) / interval)
+		}
+
+		if first < 0 {
+			first = 0
+		}
+		if last >= points {
+			last = points - 1
+		}
+
+		for i := first; i <= last; i++ {
+			switch target {
+			case TargetSessionDuration:
+				v[i] += p.GetDuration(d.timeout).Seconds()
+			default:
+				v[i]++
+			}
+		}
+	}
+
+	uids := make([]string, 0, len(values))
+	for uid := range values {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	series := make([]TimeSeries, 0, len(uids))
+	for _, uid := range uids {
+		ts := TimeSeries{Target: names[uid], Datapoints: make([][2]float64, points)}
+		for i, v := range values[uid] {
+			ts.Datapoints[i] = [2]float64{v, float64(unixMillis(from.Add(time.Duration(i) * interval)))}
+		}
+		series = append(series, ts)
+	}
+
+	return series
+}
+
+func (d *Datasource) topUsers(sessions []payload.Payload) Table {
+	type user struct {
+		login    string
+		sessions int
+		duration float64
+		focused  float64
+		lastSeen time.Time
+	}
+
+	users := map[string]*user{}
+	for _, p := range sessions {
+		u, ok := users[p.User.Login]
+		if !ok {
+			u = &user{login: p.User.Login}
+			users[p.User.Login] = u
+		}
+		u.sessions++
+		u.duration += p.GetDuration(d.timeout).Seconds()
+		u.focused += p.GetFocusedDuration(d.timeout).Seconds()
+		if lastSeen := p.GetLastSeen(); lastSeen.After(u.lastSeen) {
+			u.lastSeen = lastSeen
+		}
+	}
+
+	sorted := make([]*user, 0, len(users))
+	for _, u := range users {
+		sorted = append(sorted, u)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].duration == sorted[j].duration {
+			return sorted[i].login < sorted[j].login
+		}
+		return sorted[i].duration > sorted[j].duration
+	})
+
+	t := Table{
+		Type: "table",
+		Columns: []TableColumn{
+			{Text: "User", Type: "string"},
+			{Text: "Sessions", Type: "number"},
+			{Text: "Duration", Type: "number"},
+			{Text: "Focused Duration", Type: "number"},
+			{Text: "Last Seen", Type: "time"},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, u := range sorted {
+		t.Rows = append(t.Rows, []interface{}{u.login, u.sessions, u.duration, u.focused, unixMillis(u.lastSeen)})
+	}
+
+	return t
+}
+
+func (d *Datasource) dashboards(sessions []payload.Payload) Table {
+	type dashboard struct {
+		uid      string
+		name     string
+		sessions int
+		users    map[string]bool
+		duration float64
+		lastSeen time.Time
+	}
+
+	dashboards := map[string]*dashboard{}
+	for _, p := range sessions {
+		db, ok := dashboards[p.Dashboard.UID]
+		if !ok {
+			db = &dashboard{uid: p.Dashboard.UID, users: map[string]bool{}}
+			dashboards[p.Dashboard.UID] = db
+		}
+		db.name = p.Dashboard.Name
+		db.sessions++
+		db.users[p.User.Login] = true
+		db.duration += p.GetDuration(d.timeout).Seconds()
+		if lastSeen := p.GetLastSeen(); lastSeen.After(db.lastSeen) {
+			db.lastSeen = lastSeen
+		}
+	}
+
+	sorted := make([]*dashboard, 0, len(dashboards))
+	for _, db := range dashboards {
+		sorted = append(sorted, db)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].sessions == sorted[j].sessions {
+			return sorted[i].uid < sorted[j].uid
+		}
+		return sorted[i].sessions > sorted[j].sessions
+	})
+
+	t := Table{
+		Type: "table",
+		Columns: []TableColumn{
+			{Text: "Dashboard", Type: "string"},
+			{Text: "UID", Type: "string"},
+			{Text: "Sessions", Type: "number"},
+			{Text: "Users", Type: "number"},
+			{Text: "Duration", Type: "number"},
+			{Text: "Last Seen", Type: "time"},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, db := range sorted {
+		t.Rows = append(t.Rows, []interface{}{db.name, db.uid, db.sessions, len(db.users), db.duration, unixMillis(db.lastSeen)})
+	}
+
+	return t
+}
+
+func (d *Datasource) sessionList(sessions []payload.Payload) Table {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].GetStartTime().After(sessions[j].GetStartTime())
+	})
+
+	t := Table{
+		Type: "table",
+		Columns: []TableColumn{
+			{Text: "Start", Type: "time"},
+			{Text: "Last Seen", Type: "time"},
+			{Text: "Dashboard", Type: "string"},
+			{Text: "User", Type: "string"},
+			{Text: "Duration", Type: "number"},
+			{Text: "Focused Duration", Type: "number"},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, p := range sessions {
+		t.Rows = append(t.Rows, []interface{}{
+			unixMillis(p.GetStartTime()),
+			unixMillis(p.GetLastSeen()),
+			p.Dashboard.Name,
+			d.login(p),
+			p.GetDuration(d.timeout).Seconds(),
+			p.GetFocusedDuration(d.timeout).Seconds(),
+		})
+	}
+
+	return t
+}
+
+// annotations marks each session as a region, from its start to when it was
+// last seen.
+func (d *Datasource) annotations(w http.ResponseWriter, r *http.Request) {
+	req := AnnotationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := strings.TrimSpace(req.Annotation.Query)
+	annotations := []Annotation{}
+	for _, p := range find(d.store, filter{from: req.Range.From, to: req.Range.To}) {
+		login := d.login(p)
+		if query != "" && query != p.Dashboard.UID && (login == "" || query != login) {
+			continue
+		}
+
+		tags := []string{p.Dashboard.UID}
+		if login != "" {
+			tags = append(tags, login)
+		}
+		annotations = append(annotations, Annotation{
+			Time:     unixMillis(p.GetStartTime()),
+			TimeEnd:  unixMillis(p.GetLastSeen()),
+			IsRegion: true,
+			Title:    login,
+			Text:     fmt.Sprintf("Viewed %s for %s", p.Dashboard.Name, p.GetDuration(d.timeout)),
+			Tags:     tags,
+		})
+	}
+
+	writeJSON(w, annotations, d.logger)
+}
+
+// targets returns the targets offered, which exclude top_users if user data
+// is disabled.
+func (d *Datasource) targets() []string {
+	if d.userData {
+		return targets
+	}
+
+	offered := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if t != TargetTopUsers {
+			offered = append(offered, t)
+		}
+	}
+
+	return offered
+}
+
+// login returns the session's user login, or an empty string if user data is
+// disabled.
+func (d *Datasource) login(p payload.Payload) string {
+	if !d.userData {
+		return ""
+	}
+
+	return p.User.Login
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
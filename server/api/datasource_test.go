@@ -0,0 +1,204 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/api"
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+)
+
+func newDatasource(t *testing.T, events []event, userData bool) *httptest.Server {
+	cache := cacher.NewCache(0, 0)
+	for _, e := range events {
+		request := payloadtest.GetPayload(t)
+		request.UUID = e.uuid
+		request.Dashboard.UID = e.dashboard
+		request.Dashboard.Name = e.dashboard
+		request.User.Login = e.login
+		request.Type = e.eventType
+		request.Time = e.time
+		payload.ProcessPayload(cache, request, logger)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/grafana/", api.NewDatasource("/grafana", cache, time.Duration(0), userData, logger))
+
+	return httptest.NewServer(mux)
+}
+
+func post(t *testing.T, url string, body interface{}, status int, v interface{}) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("Expected status %d for %s, got %d", status, url, resp.StatusCode)
+	}
+	if v == nil {
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queryRange() map[string]string {
+	return map[string]string{
+		"from": time.Unix(0, 0).UTC().Format(time.RFC3339),
+		"to":   time.Unix(3599, 0).UTC().Format(time.RFC3339),
+	}
+}
+
+func TestDatasourceSearch(t *testing.T) {
+	testserver := newDatasource(t, events, true)
+	defer testserver.Close()
+
+	get(t, testserver.URL+"/grafana/", http.StatusOK, nil)
+
+	targets := []string{}
+	post(t, testserver.URL+"/grafana/search", map[string]string{"target": ""}, http.StatusOK, &targets)
+	if len(targets) == 0 || targets[0] != api.TargetSessions {
+		t.Errorf("Expected targets starting with %s, got %v", api.TargetSessions, targets)
+	}
+}
+
+func TestDatasourceTimeSeries(t *testing.T) {
+	testserver := newDatasource(t, events, true)
+	defer testserver.Close()
+
+	series := []api.TimeSeries{}
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range":      queryRange(),
+		"intervalMs": 1800 * 1000,
+		"targets":    []map[string]string{{"target": api.TargetSessions, "refId": "A"}},
+	}, http.StatusOK, &series)
+
+	if len(series) != 2 {
+		t.Fatalf("Expected a series per dashboard, got %+v", series)
+	}
+
+	expected := [][2]float64{{1, 0}, {1, 1800 * 1000}}
+	for i, dp := range series[0].Datapoints {
+		if dp != expected[i] {
+			t.Errorf("Expected datapoint %d of %s to be %v, got %v", i, series[0].Target, expected[i], dp)
+		}
+	}
+}
+
+func TestDatasourceMaxDataPoints(t *testing.T) {
+	testserver := newDatasource(t, events, true)
+	defer testserver.Close()
+
+	series := []api.TimeSeries{}
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range": map[string]string{
+			"from": time.Unix(0, 0).UTC().Format(time.RFC3339),
+			"to":   time.Unix(10*365*86400, 0).UTC().Format(time.RFC3339),
+		},
+		"intervalMs": 1000,
+		"targets":    []map[string]string{{"target": api.TargetSessions, "refId": "A"}},
+	}, http.StatusOK, &series)
+
+	if len(series) == 0 {
+		t.Fatalf("Expected a series per dashboard, got %+v", series)
+	}
+	if len(series[0].Datapoints) > api.MaxDataPoints {
+		t.Errorf("Expected at most %d datapoints, got %d", api.MaxDataPoints, len(series[0].Datapoints))
+	}
+
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range":         queryRange(),
+		"maxDataPoints": -1,
+		"targets":       []map[string]string{{"target": api.TargetSessions, "refId": "A"}},
+	}, http.StatusBadRequest, nil)
+}
+
+func TestDatasourceTable(t *testing.T) {
+	testserver := newDatasource(t, events, true)
+	defer testserver.Close()
+
+	tables := []api.Table{}
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range":   queryRange(),
+		"targets": []map[string]string{{"target": api.TargetTopUsers, "refId": "A", "type": "table"}},
+	}, http.StatusOK, &tables)
+
+	if len(tables) != 1 || len(tables[0].Rows) != 2 {
+		t.Fatalf("Expected a table with a row per user, got %+v", tables)
+	}
+	if tables[0].Rows[0][0] != "alice" || tables[0].Rows[0][2] != float64(660) {
+		t.Errorf("Expected alice with a duration of 660 first, got %v", tables[0].Rows[0])
+	}
+}
+
+func TestDatasourceAnnotations(t *testing.T) {
+	testserver := newDatasource(t, events, true)
+	defer testserver.Close()
+
+	annotations := []api.Annotation{}
+	post(t, testserver.URL+"/grafana/annotations", map[string]interface{}{
+		"range":      queryRange(),
+		"annotation": map[string]string{"name": "Sessions", "query": "bob"},
+	}, http.StatusOK, &annotations)
+
+	if len(annotations) != 1 || annotations[0].Time != 2000*1000 || annotations[0].TimeEnd != 2300*1000 {
+		t.Errorf("Expected a single annotation for bob, got %+v", annotations)
+	}
+}
+
+func TestDatasourceUserDataDisabled(t *testing.T) {
+	testserver := newDatasource(t, events, false)
+	defer testserver.Close()
+
+	targets := []string{}
+	post(t, testserver.URL+"/grafana/search", map[string]string{"target": ""}, http.StatusOK, &targets)
+	for _, target := range targets {
+		if target == api.TargetTopUsers {
+			t.Errorf("Expected %s not to be offered, got %v", api.TargetTopUsers, targets)
+		}
+	}
+
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range":   queryRange(),
+		"targets": []map[string]string{{"target": api.TargetTopUsers, "refId": "A", "type": "table"}},
+	}, http.StatusBadRequest, nil)
+
+	tables := []api.Table{}
+	post(t, testserver.URL+"/grafana/query", map[string]interface{}{
+		"range":   queryRange(),
+		"targets": []map[string]string{{"target": api.TargetSessionList, "refId": "A", "type": "table"}},
+	}, http.StatusOK, &tables)
+	if len(tables) != 1 {
+		t.Fatalf("Expected a single table, got %+v", tables)
+	}
+	for _, row := range tables[0].Rows {
+		if row[3] != "" {
+			t.Errorf("Expected sessions without their user, got %v", row)
+		}
+	}
+
+	annotations := []api.Annotation{}
+	post(t, testserver.URL+"/grafana/annotations", map[string]interface{}{
+		"range":      queryRange(),
+		"annotation": map[string]string{"name": "Sessions", "query": "bob"},
+	}, http.StatusOK, &annotations)
+	if len(annotations) != 0 {
+		t.Errorf("Expected no annotations for a user, got %+v", annotations)
+	}
+}
@@ -1,37 +1,276 @@
 package cacher
 
 import (
+	"container/list"
+	"sync"
 	"time"
 
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	gocache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	// Expiration is the expiration of items in Cache.
-	Expiration = gocache.NoExpiration
+	namespace = "grafana"
+	subsystem = "analytics"
+
+	// EvictedSize is the eviction reason for items removed to stay under the max size.
+	EvictedSize = "size"
+	// EvictedTTL is the eviction reason for items which were idle for longer than the TTL.
+	EvictedTTL = "ttl"
 )
 
-// Cacher is a cache for payloads.
-type Cacher = gocache.Cache
+type entry struct {
+	uuid    string
+	payload payload.Payload
+	updated time.Time
+}
+
+// Cacher is the default, in-memory payload.SessionStore. Once it holds more
+// than its max size, the least recently updated sessions are evicted one by
+// one. Sessions which have not been updated within the TTL are evicted by the
+// janitor.
+type Cacher struct {
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	order     *list.List // Front is the most recently updated.
+	maxSize   int
+	ttl       time.Duration
+	onEvicted func(string, payload.Payload)
+
+	evictions *prometheus.CounterVec
+	size      prometheus.GaugeFunc
+}
+
+var _ payload.SessionStore = (*Cacher)(nil)
+
+// NewCache creates a new in-memory Cache for payloads. A maxSize or ttl of 0
+// disables the respective eviction.
+func NewCache(maxSize int, ttl time.Duration) *Cacher {
+	c := &Cacher{
+		items:   map[string]*list.Element{},
+		order:   list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
+		evictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "cache_evictions_total",
+				Help:      "Number of sessions evicted from the cache.",
+			},
+			[]string{"reason"},
+		),
+	}
+	c.size = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cache_sessions",
+			Help:      "Number of sessions in the cache.",
+		},
+		func() float64 { return float64(c.Count()) },
+	)
+
+	// Initialize the reasons so that the first eviction is counted as an increase.
+	c.evictions.WithLabelValues(EvictedSize)
+	c.evictions.WithLabelValues(EvictedTTL)
 
-// NewCache creates a new in-memory Cache for payloads.
-func NewCache() *Cacher {
-	cacher := gocache.New(Expiration, Expiration)
-	return cacher
+	return c
 }
 
-// StartFlusher removes all items from the cache when maxCacheSize is exceeded.
-func StartFlusher(cache *Cacher, maxCacheSize int, logger log.Logger) {
+// OnEvicted sets a function that is called with each evicted or flushed
+// session. It is not called for sessions removed with Delete.
+func (c *Cacher) OnEvicted(f func(string, payload.Payload)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onEvicted = f
+}
+
+// Get returns a session without changing its recency.
+func (c *Cacher) Get(uuid string) (payload.Payload, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[uuid]
+	if !ok {
+		return payload.Payload{}, false
+	}
+
+	return el.Value.(*entry).payload, true
+}
+
+// Upsert stores the result of update and marks the session as the most
+// recently updated.
+func (c *Cacher) Upsert(uuid string, update func(p payload.Payload, exists bool) payload.Payload) {
+	c.mu.Lock()
+	var p payload.Payload
+	el, exists := c.items[uuid]
+	if exists {
+		p = el.Value.(*entry).payload
+	}
+	c.set(uuid, update(p, exists))
+	evicted := c.evictSize()
+	c.mu.Unlock()
+
+	c.evicted(evicted)
+}
+
+// Range calls f for each session, from the least recently updated, until f
+// returns false. The cache is not locked while f is called.
+func (c *Cacher) Range(f func(uuid string, p payload.Payload) bool) {
+	c.mu.Lock()
+	entries := make([]entry, 0, len(c.items))
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, *el.Value.(*entry))
+	}
+	c.mu.Unlock()
+
+	for _, e := range entries {
+		if !f(e.uuid, e.payload) {
+			return
+		}
+	}
+}
+
+// Delete removes a session.
+func (c *Cacher) Delete(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[uuid]; ok {
+		c.order.Remove(el)
+		delete(c.items, uuid)
+	}
+}
+
+// Count returns the number of sessions.
+func (c *Cacher) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// Flush removes all items from the cache.
+func (c *Cacher) Flush() {
+	c.mu.Lock()
+	flushed := make([]*entry, 0, len(c.items))
+	for _, el := range c.items {
+		flushed = append(flushed, el.Value.(*entry))
+	}
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	c.mu.Unlock()
+
+	c.evicted(flushed)
+}
+
+// DeleteExpired evicts all items which have not been updated within the TTL,
+// and returns the number of evicted items.
+func (c *Cacher) DeleteExpired() int {
+	if c.ttl == 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	var evicted []*entry
+	cutoff := time.Now().Add(-c.ttl)
+	for el := c.order.Back(); el != nil; el = c.order.Back() {
+		e := el.Value.(*entry)
+		if e.updated.After(cutoff) {
+			break
+		}
+		c.order.Remove(el)
+		delete(c.items, e.uuid)
+		evicted = append(evicted, e)
+	}
+	c.evictions.WithLabelValues(EvictedTTL).Add(float64(len(evicted)))
+	c.mu.Unlock()
+
+	c.evicted(evicted)
+	return len(evicted)
+}
+
+// Describe describes the cache metrics.
+func (c *Cacher) Describe(ch chan<- *prometheus.Desc) {
+	c.evictions.Describe(ch)
+	c.size.Describe(ch)
+}
+
+// Collect collects the cache metrics.
+func (c *Cacher) Collect(ch chan<- prometheus.Metric) {
+	c.evictions.Collect(ch)
+	c.size.Collect(ch)
+}
+
+// set stores a session at the front of the eviction order. It must be called
+// while holding the lock.
+func (c *Cacher) set(uuid string, p payload.Payload) {
+	e := &entry{uuid: uuid, payload: p, updated: time.Now()}
+
+	if el, ok := c.items[uuid]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[uuid] = c.order.PushFront(e)
+}
+
+// evictSize removes the least recently updated items until the cache is
+// within its max size. It must be called while holding the lock.
+func (c *Cacher) evictSize() []*entry {
+	if c.maxSize == 0 {
+		return nil
+	}
+
+	var evicted []*entry
+	for len(c.items) > c.maxSize {
+		el := c.order.Back()
+		e := el.Value.(*entry)
+		c.order.Remove(el)
+		delete(c.items, e.uuid)
+		evicted = append(evicted, e)
+	}
+	c.evictions.WithLabelValues(EvictedSize).Add(float64(len(evicted)))
+
+	return evicted
+}
+
+// evicted calls the OnEvicted function for each evicted entry. It must be
+// called without holding the lock, so the function may use the cache.
+func (c *Cacher) evicted(evicted []*entry) {
+	if len(evicted) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	onEvicted := c.onEvicted
+	c.mu.Unlock()
+
+	if onEvicted == nil {
+		return
+	}
+
+	for _, e := range evicted {
+		onEvicted(e.uuid, e.payload)
+	}
+}
+
+// StartJanitor evicts idle items from the cache at the given interval.
+func StartJanitor(cache *Cacher, interval time.Duration, logger log.Logger) {
 	for {
-		if cache.ItemCount() > maxCacheSize {
-			level.Info(logger).Log(
-				"msg", "Flushing cache since it exceeded the size limit",
-				"maxsize", maxCacheSize,
+		time.Sleep(interval)
+
+		if expired := cache.DeleteExpired(); expired > 0 {
+			level.Debug(logger).Log(
+				"msg", "Evicted idle sessions from the cache",
+				"count", expired,
+				"ttl", cache.ttl,
 			)
-			cache.Flush()
 		}
-		time.Sleep(time.Second)
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/go-kit/kit/log"
 )
 
@@ -14,24 +15,101 @@ var (
 	logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
 )
 
-func TestFlushOnMaxSizeExceeded(t *testing.T) {
+func set(cache *cacher.Cacher, uuid string) {
+	cache.Upsert(uuid, func(payload.Payload, bool) payload.Payload {
+		return payload.Payload{UUID: uuid}
+	})
+}
+
+func TestEvictOldestOnMaxSizeExceeded(t *testing.T) {
 	maxSize := 10
-	cache := cacher.NewCache()
-	go cacher.StartFlusher(cache, maxSize, logger)
+	cache := cacher.NewCache(maxSize, 0)
+
+	var evicted []string
+	cache.OnEvicted(func(uuid string, _ payload.Payload) {
+		evicted = append(evicted, uuid)
+	})
 
 	for i := 0; i < maxSize; i++ {
-		cache.Add(fmt.Sprint(i), nil, -1)
+		set(cache, fmt.Sprint(i))
+	}
+	cacheItemCountBeforeEviction := cache.Count()
+	if cacheItemCountBeforeEviction != maxSize {
+		t.Errorf("Expected '%d' items, got '%d'", maxSize, cacheItemCountBeforeEviction)
+	}
+
+	// Updating an item makes it the most recently updated, so "1" is now the oldest.
+	set(cache, "0")
+	set(cache, "hello")
+
+	cacheItemCountAfterEviction := cache.Count()
+	if cacheItemCountAfterEviction != maxSize {
+		t.Errorf("Expected '%d' items, got '%d'", maxSize, cacheItemCountAfterEviction)
+	}
+	if len(evicted) != 1 || evicted[0] != "1" {
+		t.Errorf("Expected only '1' to be evicted, got %v", evicted)
+	}
+	if _, exists := cache.Get("0"); !exists {
+		t.Error("Expected recently updated item '0' to remain in the cache")
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	cache := cacher.NewCache(0, ttl)
+	go cacher.StartJanitor(cache, 50*time.Millisecond, logger)
+
+	set(cache, "idle")
+	set(cache, "active")
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+		set(cache, "active")
+	}
+
+	if _, exists := cache.Get("idle"); exists {
+		t.Error("Expected idle item to be evicted")
+	}
+	if _, exists := cache.Get("active"); !exists {
+		t.Error("Expected active item to remain in the cache")
 	}
-	time.Sleep(100 * time.Millisecond)
-	cacheItemCountBeforeFlush := cache.ItemCount()
-	if cacheItemCountBeforeFlush != maxSize {
-		t.Errorf("Expected '%d' items, got '%d'", maxSize, cacheItemCountBeforeFlush)
+}
+
+func TestUpsert(t *testing.T) {
+	cache := cacher.NewCache(0, 0)
+
+	for i := 0; i < 3; i++ {
+		cache.Upsert("a", func(p payload.Payload, exists bool) payload.Payload {
+			if exists != (i > 0) {
+				t.Errorf("Expected exists to be '%t' on upsert %d", i > 0, i)
+			}
+			p.Time++
+			return p
+		})
 	}
 
-	cache.Add("hello", nil, -1)
-	time.Sleep(1100 * time.Millisecond)
-	cacheItemCountAfterFlush := cache.ItemCount()
-	if cacheItemCountAfterFlush != 0 {
-		t.Errorf("Expected '%d' items, got '%d'", 0, cacheItemCountAfterFlush)
+	p, _ := cache.Get("a")
+	if p.Time != 3 {
+		t.Errorf("Expected each upsert to see the previous item, got '%d'", p.Time)
+	}
+}
+
+func TestRangeOrder(t *testing.T) {
+	cache := cacher.NewCache(0, 0)
+
+	set(cache, "a")
+	set(cache, "b")
+	set(cache, "c")
+	set(cache, "a")
+
+	var order []string
+	cache.Range(func(uuid string, _ payload.Payload) bool {
+		order = append(order, uuid)
+		return true
+	})
+
+	expected := "[b c a]"
+	if fmt.Sprint(order) != expected {
+		t.Errorf("Expected the order '%s', got '%v'", expected, order)
 	}
 }
@@ -4,7 +4,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -16,24 +16,54 @@ const (
 	subsystem = "analytics"
 )
 
-// Exporter is an exporter for metrics derrived from payloads in the cache.
+// Exporter is an exporter for metrics derrived from payloads in the session store.
+// Counters are never reset. Instead, each session's contribution is tracked
+// while it is stored, and only increases are added to the counters.
 type Exporter struct {
-	SessionCount    *prometheus.CounterVec
-	SessionDuration *prometheus.CounterVec
+	SessionCount             *prometheus.CounterVec
+	SessionDuration          *prometheus.CounterVec
+	SessionFocusedDuration   *prometheus.CounterVec
+	SessionUnfocusedDuration *prometheus.CounterVec
+	ActiveSessions           *prometheus.GaugeVec
+	UniqueUsers              *prometheus.GaugeVec
+	DashboardInfo            *prometheus.GaugeVec
+
+	// Histograms are observed once per session, when it ends or is evicted.
+	durationHistogram *prometheus.Desc
+	focusedHistogram  *prometheus.Desc
+	buckets           []float64
 
 	mu            sync.Mutex
+	sessions      map[string]reported
+	totals        map[string]*Total
+	users         map[string]*DashboardUsers
+	views         map[string]View
 	up            prometheus.Gauge
 	totalScrapes  prometheus.Counter
 	queryFailures prometheus.Counter
 
-	cache       *cacher.Cacher
+	store       payload.SessionStore
+	inventory   *inventory.Inventory
+	dashboards  map[string]string // The dashboard names by UID, as last synced.
+	deleted     map[string]bool   // UIDs of dashboards deleted from the inventory.
 	timeout     time.Duration
 	userMetrics bool
 	logger      log.Logger
 }
 
-// NewExporter creates an Exporter.
-func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool, logger log.Logger) *Exporter {
+// reported is the contribution of a stored session which has already been
+// added to the counters.
+type reported struct {
+	duration  float64
+	focused   float64
+	unfocused float64
+	observed  bool
+}
+
+// NewExporter creates an Exporter. If buckets is empty, DefaultDurationBuckets
+// are used for the duration histograms. The inventory may be nil, in which
+// case series only exist for dashboards with sessions.
+func NewExporter(store payload.SessionStore, inventory *inventory.Inventory, timeout time.Duration, userMetrics bool, buckets []float64, logger log.Logger) *Exporter {
 	labels := []string{
 		"grafana_host",
 		"grafana_env",
@@ -50,6 +80,10 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 		labels = append(labels, "user_login", "user_name")
 	}
 
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+
 	return &Exporter{
 		SessionCount: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -69,6 +103,54 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 			},
 			labels,
 		),
+		SessionFocusedDuration: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sessions_focused_duration_seconds_total",
+				Help:      "Duration of sessions during which the dashboard had focus.",
+			},
+			labels,
+		),
+		SessionUnfocusedDuration: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sessions_unfocused_duration_seconds_total",
+				Help:      "Duration of sessions during which the dashboard did not have focus.",
+			},
+			labels,
+		),
+		durationHistogram: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "session_duration_seconds"),
+			"Duration of finished or expired sessions.",
+			labels, nil,
+		),
+		focusedHistogram: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "session_focused_duration_seconds"),
+			"Duration of finished or expired sessions during which the dashboard had focus.",
+			labels, nil,
+		),
+		buckets: buckets,
+		ActiveSessions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "active_sessions",
+				Help:      "Number of sessions which have not ended and were seen within the session timeout.",
+			},
+			[]string{"dashboard_name", "dashboard_uid"},
+		),
+		UniqueUsers: newUniqueUsers(),
+		DashboardInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "dashboard_info",
+				Help:      "Metadata of each dashboard in Grafana. Tags are sorted, and enclosed and separated by commas.",
+			},
+			[]string{"dashboard_name", "dashboard_uid", "folder_uid", "folder_title", "tags"},
+		),
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
@@ -87,7 +169,14 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 			Name:      "exporter_query_failures_total",
 			Help:      "Number of errors.",
 		}),
-		cache:       cache,
+		sessions:    map[string]reported{},
+		totals:      map[string]*Total{},
+		users:       map[string]*DashboardUsers{},
+		views:       map[string]View{},
+		store:       store,
+		inventory:   inventory,
+		dashboards:  map[string]string{},
+		deleted:     map[string]bool{},
 		timeout:     timeout,
 		userMetrics: userMetrics,
 		logger:      logger,
@@ -96,6 +185,8 @@ func NewExporter(cache *cacher.Cacher, timeout time.Duration, userMetrics bool,
 
 // Describe describes all metrics with constant descriptions.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.durationHistogram
+	ch <- e.focusedHistogram
 	ch <- e.up.Desc()
 	ch <- e.totalScrapes.Desc()
 	ch <- e.queryFailures.Desc()
@@ -106,9 +197,6 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mu.Lock() // To protect metrics from concurrent collects.
 	defer e.mu.Unlock()
 
-	e.SessionCount.Reset()
-	e.SessionDuration.Reset()
-
 	err := e.scrape(ch)
 	up := float64(1)
 	if err != nil {
@@ -121,72 +209,174 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 	e.SessionCount.Collect(ch)
 	e.SessionDuration.Collect(ch)
+	e.SessionFocusedDuration.Collect(ch)
+	e.SessionUnfocusedDuration.Collect(ch)
+	e.ActiveSessions.Collect(ch)
+	e.UniqueUsers.Collect(ch)
+	e.DashboardInfo.Collect(ch)
+	e.collectHistograms(ch)
 
 	ch <- e.up
 	ch <- e.totalScrapes
 	ch <- e.queryFailures
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) error {
-	cacheItems := e.cache.Items()
-	for _, c := range cacheItems {
-		p := c.Object.(payload.Payload)
-
-		var theme string
-		if p.User.LightTheme {
-			theme = "light"
-		} else {
-			theme = "dark"
+// Fold adds the final contribution of a session which is leaving the store
+// to the counters, and stops tracking it.
+func (e *Exporter) Fold(uuid string, p payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.deleted[p.Dashboard.UID] {
+		err := e.update(uuid, p, true)
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Failed to fold evicted session", "uuid", uuid, "err", err)
 		}
+	}
+	delete(e.sessions, uuid)
+}
 
-		var role string
-		if p.User.IsGrafanaAdmin {
-			role = "admin"
-		} else if p.User.HasEditPermissionInFolders {
-			role = "editor"
-		} else {
-			role = "user"
+func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric) {
+	for _, t := range e.totals {
+		for _, h := range []struct {
+			desc      *prometheus.Desc
+			histogram *Histogram
+		}{
+			{e.durationHistogram, &t.DurationHistogram},
+			{e.focusedHistogram, &t.FocusedHistogram},
+		} {
+			m, err := h.histogram.metric(h.desc, e.buckets, t.Labels)
+			if err != nil {
+				level.Error(e.logger).Log("msg", "Failed to collect histogram", "err", err)
+				continue
+			}
+			ch <- m
 		}
+	}
+}
+
+func (e *Exporter) scrape(ch chan<- prometheus.Metric) error {
+	now := time.Now()
+
+	e.ActiveSessions.Reset()
 
-		labels := []string{
-			p.Host.Hostname + ":" + p.Host.Port,
-			p.Host.BuildInfo.Env,
-			p.Dashboard.Name,
-			p.Dashboard.UID,
-			p.TimeZone,
-			theme,
-			p.User.Timezone,
-			p.User.Locale,
-			role,
+	var err error
+	e.store.Range(func(uuid string, p payload.Payload) bool {
+		// Sessions of deleted dashboards may stay in the store until they
+		// expire, but must not recreate the dashboard's series.
+		if e.deleted[p.Dashboard.UID] {
+			return true
 		}
 
-		if e.userMetrics {
-			labels = append(labels, p.User.Login, p.User.Name)
+		// Dashboards with stored sessions are initialized, even without active sessions.
+		active := e.ActiveSessions.WithLabelValues(dashboardName(e.inventory, p.Dashboard), p.Dashboard.UID)
+		if p.IsActive(now, e.timeout) {
+			active.Inc()
 		}
 
+		err = e.update(uuid, p, false)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sessions missing from the store are not pruned here, since they may be
+	// evicted but not yet folded. Fold stops tracking them.
+
+	e.updateUniqueUsers(now)
+	e.syncDashboards()
+
+	return nil
+}
+
+// update adds any increase in a session's contribution to the counters, and
+// observes the session once it has ended or is final.
+func (e *Exporter) update(uuid string, p payload.Payload, final bool) error {
+	var theme string
+	if p.User.LightTheme {
+		theme = "light"
+	} else {
+		theme = "dark"
+	}
+
+	var role string
+	if p.User.IsGrafanaAdmin {
+		role = "admin"
+	} else if p.User.HasEditPermissionInFolders {
+		role = "editor"
+	} else {
+		role = "user"
+	}
+
+	labels := []string{
+		p.Host.Hostname + ":" + p.Host.Port,
+		p.Host.BuildInfo.Env,
+		dashboardName(e.inventory, p.Dashboard),
+		p.Dashboard.UID,
+		p.TimeZone,
+		theme,
+		p.User.Timezone,
+		p.User.Locale,
+		role,
+	}
+
+	if e.userMetrics {
+		labels = append(labels, p.User.Login, p.User.Name)
+	}
+
+	e.seeUser(p)
+	e.seeView(p)
+
+	r, tracked := e.sessions[uuid]
+	if !tracked {
 		sessionCount, err := e.SessionCount.GetMetricWithLabelValues(labels...)
 		if err != nil {
 			return err
 		}
 
-		// We want to initialize all dashboard metrics. However, we do not want to increase count for initialized metrics.
-		// Otherwise, we create false metrics. Having all metrics initialized for dashboards is useful to see which dashboards are not in use
-		if p.User.Name != payload.ANALYTICS_USER {
-			sessionCount.Inc()
-		}
+		sessionCount.Inc()
+		e.total(labels).Sessions++
+	}
 
-		startSet, hbSet, endSet := p.IsTimeSet()
-		if !startSet {
-			level.Error(e.logger).Log("msg", "Start time is not set for session", "uuid", p.UUID)
-		} else if endSet || hbSet {
-			sessionDuration, err := e.SessionDuration.GetMetricWithLabelValues(labels...)
+	startSet, hbSet, endSet := p.IsTimeSet()
+	if !startSet {
+		level.Error(e.logger).Log("msg", "Start time is not set for session", "uuid", p.UUID)
+	} else if endSet || hbSet {
+		duration := p.GetDuration(e.timeout)
+		focused := p.GetFocusedDuration(e.timeout)
+		total := e.total(labels)
+
+		for _, c := range []struct {
+			vec      *prometheus.CounterVec
+			value    float64
+			reported *float64
+			total    *float64
+		}{
+			{e.SessionDuration, duration.Seconds(), &r.duration, &total.Duration},
+			{e.SessionFocusedDuration, focused.Seconds(), &r.focused, &total.Focused},
+			{e.SessionUnfocusedDuration, (duration - focused).Seconds(), &r.unfocused, &total.Unfocused},
+		} {
+			counter, err := c.vec.GetMetricWithLabelValues(labels...)
 			if err != nil {
 				return err
 			}
 
-			sessionDuration.Add(p.GetDuration(e.timeout).Seconds())
+			if c.value > *c.reported {
+				counter.Add(c.value - *c.reported)
+				*c.total += c.value - *c.reported
+				*c.reported = c.value
+			}
 		}
 	}
 
+	if startSet && (endSet || final) && !r.observed {
+		total := e.total(labels)
+		total.DurationHistogram.observe(e.buckets, p.GetDuration(e.timeout).Seconds())
+		total.FocusedHistogram.observe(e.buckets, p.GetFocusedDuration(e.timeout).Seconds())
+		r.observed = true
+	}
+
+	e.sessions[uuid] = r
 	return nil
 }
@@ -10,8 +10,10 @@ import (
 
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
 	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
 	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,11 +23,12 @@ var (
 	payloadURL     = "/write"
 	metricsURL     = "/metrics"
 	logger         = log.NewNopLogger()
-	cache          = cacher.NewCache()
-	metricExporter = collector.NewExporter(cache, time.Duration(0), true, logger)
+	cache          = cacher.NewCache(0, 0)
+	metricExporter = collector.NewExporter(cache, nil, time.Duration(0), true, nil, logger)
 )
 
 func init() {
+	cache.OnEvicted(metricExporter.Fold)
 	prometheus.MustRegister(metricExporter)
 }
 
@@ -46,7 +49,7 @@ func getMetrics(t *testing.T, url string) string {
 func newMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	handler := payload.NewHandler(cache, 10, true, true, true, logger)
+	handler := payload.NewHandler(cache, nil, nil, 10, true, true, true, logger)
 	mux.Handle(payloadURL, handler)
 
 	mux.Handle(metricsURL, promhttp.Handler())
@@ -120,3 +123,317 @@ func TestDurationSeconds(t *testing.T) {
 
 	cache.Flush()
 }
+
+func TestCountersSurviveEviction(t *testing.T) {
+	testserver := httptest.NewServer(newMux())
+	defer testserver.Close()
+
+	request1 := payloadtest.GetPayload(t)
+	request1.UUID = "evicted1"
+	request1.Type = "start"
+	request1.Dashboard.UID = "evicted"
+	request1.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request1)
+
+	request2 := payloadtest.GetPayload(t)
+	request2.UUID = "evicted1"
+	request2.Type = "end"
+	request2.Dashboard.UID = "evicted"
+	request2.Time = 1600000600
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request2)
+	time.Sleep(100 * time.Millisecond)
+
+	_ = getMetrics(t, testserver.URL)
+	cache.Flush()
+
+	// This session is evicted before it is ever scraped.
+	request3 := payloadtest.GetPayload(t)
+	request3.UUID = "evicted2"
+	request3.Type = "end"
+	request3.Dashboard.UID = "evicted"
+	request3.Time = 1600000000
+	payloadtest.SendPayload(t, testserver.URL+payloadURL, request3)
+	time.Sleep(100 * time.Millisecond)
+	cache.Flush()
+
+	m := getMetrics(t, testserver.URL)
+
+	expectedSessionsTotal := `grafana_analytics_sessions_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="evicted",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 2`
+	if !strings.Contains(m, expectedSessionsTotal) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedSessionsTotal, m)
+	}
+
+	expectedDurationSeconds := `grafana_analytics_sessions_duration_seconds_total{dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="evicted",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"} 600`
+	if !strings.Contains(m, expectedDurationSeconds) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedDurationSeconds, m)
+	}
+}
+
+func TestScrapeDuringEviction(t *testing.T) {
+	store := cacher.NewCache(0, 0)
+	exporter := collector.NewExporter(store, nil, time.Duration(0), false, nil, logger)
+
+	// The session is scraped after it left the cache, but before it is folded.
+	store.OnEvicted(func(uuid string, p payload.Payload) {
+		scrape(exporter)
+		exporter.Fold(uuid, p)
+	})
+
+	for _, r := range []struct {
+		eventType string
+		time      int
+	}{{"start", 1600000000}, {"end", 1600000600}} {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "interleaved"
+		request.Type = r.eventType
+		request.Time = r.time
+		payload.ProcessPayload(store, request, logger)
+	}
+
+	scrape(exporter)
+	store.Flush()
+	scrape(exporter)
+
+	state := exporter.State()
+	if len(state.Totals) != 1 {
+		t.Fatalf("Expected a single label set, got %v", state.Totals)
+	}
+	if state.Totals[0].Sessions != 1 || state.Totals[0].Duration != 600 {
+		t.Errorf("Expected '1' session of '600' seconds, got %+v", state.Totals[0])
+	}
+}
+
+func TestFocusedDuration(t *testing.T) {
+	testserver := httptest.NewServer(newMux())
+	defer testserver.Close()
+
+	events := []struct {
+		eventType string
+		hasFocus  bool
+	}{
+		{"start", true},
+		{"heartbeat", false},
+		{"heartbeat", true},
+		{"end", true},
+	}
+	for i, event := range events {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "histogram"
+		request.Type = event.eventType
+		request.HasFocus = event.hasFocus
+		request.Dashboard.UID = "histogram"
+		request.Time = 1600000000 + i*60
+		payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m := getMetrics(t, testserver.URL)
+
+	labels := `dashboard_name="New Dashboard 1234",dashboard_timezone="utc",dashboard_uid="histogram",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_login="admin",user_name="admin",user_role="admin",user_theme="dark",user_timezone="browser"`
+	expected := []string{
+		`grafana_analytics_session_duration_seconds_sum{` + labels + `} 180`,
+		`grafana_analytics_session_duration_seconds_count{` + labels + `} 1`,
+		`grafana_analytics_session_duration_seconds_bucket{` + labels + `,le="120"} 0`,
+		`grafana_analytics_session_duration_seconds_bucket{` + labels + `,le="300"} 1`,
+		`grafana_analytics_session_focused_duration_seconds_sum{` + labels + `} 120`,
+		`grafana_analytics_session_focused_duration_seconds_bucket{` + labels + `,le="120"} 1`,
+		`grafana_analytics_sessions_focused_duration_seconds_total{` + labels + `} 120`,
+		`grafana_analytics_sessions_unfocused_duration_seconds_total{` + labels + `} 60`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(m, e) {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", e, m)
+		}
+	}
+
+	// A session is only observed once, even if it is scraped again.
+	m = getMetrics(t, testserver.URL)
+	if !strings.Contains(m, expected[1]) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expected[1], m)
+	}
+
+	cache.Flush()
+}
+
+func TestActiveSessions(t *testing.T) {
+	testserver := httptest.NewServer(newMux())
+	defer testserver.Close()
+
+	now := int(time.Now().Unix())
+	sessions := []struct {
+		uuid      string
+		eventType string
+		time      int
+	}{
+		{"active", "start", now - 3600},
+		{"active", "heartbeat", now - 10},
+		{"idle", "start", now - 3600},
+		{"idle", "heartbeat", now - 600},
+		{"ended", "start", now - 60},
+		{"ended", "end", now},
+	}
+	for _, session := range sessions {
+		request := payloadtest.GetPayload(t)
+		request.UUID = session.uuid
+		request.Type = session.eventType
+		request.Dashboard.UID = "active"
+		request.Time = session.time
+		payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m := getMetrics(t, testserver.URL)
+
+	expectedActiveSessions := `grafana_analytics_active_sessions{dashboard_name="New Dashboard 1234",dashboard_uid="active"} 1`
+	if !strings.Contains(m, expectedActiveSessions) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expectedActiveSessions, m)
+	}
+
+	cache.Flush()
+}
+
+func TestUniqueUsers(t *testing.T) {
+	testserver := httptest.NewServer(newMux())
+	defer testserver.Close()
+
+	now := int(time.Now().Unix())
+	sessions := []struct {
+		uuid  string
+		login string
+		time  int
+	}{
+		{"today-1", "alice", now - 3600},
+		{"today-2", "alice", now - 60},
+		{"today-3", "bob", now - 60},
+		{"week", "carol", now - 3*24*3600},
+		{"month", "dave", now - 20*24*3600},
+		{"expired", "erin", now - 40*24*3600},
+	}
+	for _, session := range sessions {
+		request := payloadtest.GetPayload(t)
+		request.UUID = session.uuid
+		request.Type = "start"
+		request.Dashboard.UID = "users"
+		request.User.Login = session.login
+		request.Time = session.time
+		payloadtest.SendPayload(t, testserver.URL+payloadURL, request)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m := getMetrics(t, testserver.URL)
+
+	for window, count := range map[string]string{"1d": "2", "7d": "3", "30d": "4"} {
+		expected := `grafana_analytics_unique_users{dashboard_name="New Dashboard 1234",dashboard_uid="users",window="` + window + `"} ` + count
+		if !strings.Contains(m, expected) {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", expected, m)
+		}
+	}
+
+	cache.Flush()
+}
+
+func TestInventory(t *testing.T) {
+	store := cacher.NewCache(0, 0)
+	dashboards := inventory.New(worker.Client{}, logger)
+	dashboards.Set([]inventory.Dashboard{
+		{UID: "unused", Title: "Unused", FolderUID: "team", FolderTitle: "Team", Tags: []string{"b", "a"}},
+		{UID: "deleted", Title: "Deleted"},
+	})
+
+	exporter := collector.NewExporter(store, dashboards, time.Duration(0), false, nil, logger)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	testserver := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.Type = "start"
+	request.Dashboard.UID = "deleted"
+	request.Dashboard.Name = "Deleted"
+	request.Time = int(time.Now().Unix())
+	payload.ProcessPayload(store, request, logger)
+
+	m := getMetrics(t, testserver.URL)
+
+	for _, expected := range []string{
+		`grafana_analytics_sessions_total{dashboard_name="Unused",dashboard_timezone="",dashboard_uid="unused",grafana_env="",grafana_host="",user_locale="",user_role="",user_theme="",user_timezone=""} 0`,
+		`grafana_analytics_active_sessions{dashboard_name="Unused",dashboard_uid="unused"} 0`,
+		`grafana_analytics_unique_users{dashboard_name="Unused",dashboard_uid="unused",window="30d"} 0`,
+		`grafana_analytics_dashboard_info{dashboard_name="Unused",dashboard_uid="unused",folder_title="Team",folder_uid="team",tags=",a,b,"} 1`,
+		`dashboard_uid="deleted"`,
+	} {
+		if !strings.Contains(m, expected) {
+			t.Errorf("Expected metrics to contain '%s', got:\n%s", expected, m)
+		}
+	}
+
+	// The session stays in the store, but must not recreate the series of
+	// the deleted dashboard on later scrapes.
+	dashboards.Set([]inventory.Dashboard{{UID: "unused", Title: "Unused"}})
+
+	for i := 0; i < 2; i++ {
+		m = getMetrics(t, testserver.URL)
+	}
+
+	if strings.Contains(m, `dashboard_uid="deleted"`) {
+		t.Errorf("Expected metrics of the deleted dashboard to be removed, got:\n%s", m)
+	}
+}
+
+func TestInventoryRename(t *testing.T) {
+	store := cacher.NewCache(0, 0)
+	dashboards := inventory.New(worker.Client{}, logger)
+	dashboards.Set([]inventory.Dashboard{{UID: "renamed", Title: "Old"}})
+
+	exporter := collector.NewExporter(store, dashboards, time.Duration(0), false, nil, logger)
+	timeRangeExporter := collector.NewTimeRangeExporter(dashboards, 0, logger)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter, timeRangeExporter)
+
+	testserver := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer testserver.Close()
+
+	request := payloadtest.GetPayload(t)
+	request.Type = "start"
+	request.Dashboard.UID = "renamed"
+	request.Dashboard.Name = "Old"
+	request.Time = int(time.Now().Unix())
+	payload.ProcessPayload(store, request, logger)
+	timeRangeExporter.Observe(request)
+
+	m := getMetrics(t, testserver.URL)
+	if !strings.Contains(m, `dashboard_name="Old"`) {
+		t.Fatalf("Expected metrics for the old name, got:\n%s", m)
+	}
+
+	dashboards.Set([]inventory.Dashboard{{UID: "renamed", Title: "New"}})
+	getMetrics(t, testserver.URL)
+
+	request.Type = "heartbeat"
+	request.TimeRange.Raw.From = "now-1h"
+	request.Time++
+	payload.ProcessPayload(store, request, logger)
+	timeRangeExporter.Observe(request)
+
+	m = getMetrics(t, testserver.URL)
+
+	if strings.Contains(m, `dashboard_name="Old"`) {
+		t.Errorf("Expected no metrics for the old name, got:\n%s", m)
+	}
+
+	expected := `grafana_analytics_sessions_total{dashboard_name="New",dashboard_timezone="utc",dashboard_uid="renamed",grafana_env="production",grafana_host="localhost:3000",user_locale="en-US",user_role="admin",user_theme="dark",user_timezone="browser"} 1`
+	if !strings.Contains(m, expected) {
+		t.Errorf("Expected metrics to contain '%s', got:\n%s", expected, m)
+	}
+}
+
+func scrape(c prometheus.Collector) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	for range ch {
+	}
+}
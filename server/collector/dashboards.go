@@ -0,0 +1,261 @@
+package collector
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dashboardName returns the title of a dashboard in the inventory, so that
+// all series of a renamed dashboard use its current name. Dashboards missing
+// from the inventory keep the name sent with their sessions.
+func dashboardName(i *inventory.Inventory, d payload.DashboardInfo) string {
+	if i != nil {
+		if title, ok := i.Title(d.UID); ok {
+			return title
+		}
+	}
+
+	return d.Name
+}
+
+// seriesDeleter is implemented by all metric vectors.
+type seriesDeleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+type seriesKey struct {
+	vec    seriesDeleter
+	labels string
+}
+
+// dashboardSeries tracks the series of each dashboard, so that they can be
+// deleted when the dashboard is renamed or deleted.
+type dashboardSeries struct {
+	names     map[string]string // Dashboard UID to the name used in its series.
+	series    map[string]map[seriesKey][]string
+	inventory map[string]bool // Dashboard UIDs in the last synced inventory.
+}
+
+func newDashboardSeries() dashboardSeries {
+	return dashboardSeries{
+		names:     map[string]string{},
+		series:    map[string]map[seriesKey][]string{},
+		inventory: map[string]bool{},
+	}
+}
+
+// labels returns the label values of a series of a dashboard, starting with
+// its name and UID. If the dashboard was renamed, all of its series with the
+// previous name are deleted first.
+func (s dashboardSeries) labels(vec seriesDeleter, name string, uid string, rest ...string) []string {
+	if previous, ok := s.names[uid]; ok && previous != name {
+		for key, labels := range s.series[uid] {
+			key.vec.DeleteLabelValues(labels...)
+		}
+		delete(s.series, uid)
+	}
+	s.names[uid] = name
+
+	labels := append([]string{name, uid}, rest...)
+
+	series, ok := s.series[uid]
+	if !ok {
+		series = map[seriesKey][]string{}
+		s.series[uid] = series
+	}
+	series[seriesKey{vec: vec, labels: strings.Join(labels, "\xff")}] = labels
+
+	return labels
+}
+
+// sync deletes all series of dashboards which were in the previously synced
+// inventory but no longer exist, and returns their UIDs. As for the Exporter,
+// dashboards which were never in the inventory are kept.
+func (s dashboardSeries) sync(i *inventory.Inventory) []string {
+	if i == nil {
+		return nil
+	}
+
+	dashboards, ok := i.Dashboards()
+	if !ok {
+		return nil
+	}
+
+	current := make(map[string]bool, len(dashboards))
+	for _, d := range dashboards {
+		current[d.UID] = true
+	}
+
+	var deleted []string
+	for uid := range s.inventory {
+		if current[uid] {
+			continue
+		}
+		for key, labels := range s.series[uid] {
+			key.vec.DeleteLabelValues(labels...)
+		}
+		delete(s.series, uid)
+		delete(s.names, uid)
+		delete(s.inventory, uid)
+		deleted = append(deleted, uid)
+	}
+	for uid := range current {
+		s.inventory[uid] = true
+	}
+
+	return deleted
+}
+
+// syncDashboards initializes zero-valued series for each dashboard in the
+// inventory, and removes all series of dashboards which no longer exist. It
+// must be called while holding the lock, after the gauges have been set.
+func (e *Exporter) syncDashboards() {
+	if e.inventory == nil {
+		return
+	}
+
+	dashboards, ok := e.inventory.Dashboards()
+	if !ok {
+		return
+	}
+
+	e.DashboardInfo.Reset()
+
+	current := make(map[string]string, len(dashboards))
+	for _, d := range dashboards {
+		current[d.UID] = d.Title
+		delete(e.deleted, d.UID)
+		e.DashboardInfo.WithLabelValues(d.Title, d.UID, d.FolderUID, d.FolderTitle, joinTags(d.Tags)).Set(1)
+
+		if name, known := e.dashboards[d.UID]; known && name != d.Title {
+			e.deletePlaceholders(d.UID, name)
+		}
+		e.initPlaceholders(d)
+	}
+
+	for uid, name := range e.dashboards {
+		if _, exists := current[uid]; !exists {
+			e.deleteDashboard(uid, name)
+		}
+	}
+
+	for key, t := range e.totals {
+		if title, exists := current[t.Labels[3]]; exists && t.Labels[2] != title {
+			e.renameTotal(key, t, title)
+		}
+	}
+
+	e.dashboards = current
+}
+
+// renameTotal moves the counters and histograms of a label set to the
+// current name of its dashboard.
+func (e *Exporter) renameTotal(key string, t *Total, name string) {
+	for _, vec := range e.counters() {
+		vec.DeleteLabelValues(t.Labels...)
+	}
+	delete(e.totals, key)
+
+	labels := make([]string, len(t.Labels))
+	copy(labels, t.Labels)
+	labels[2] = name
+
+	renamed := e.total(labels)
+	renamed.Sessions += t.Sessions
+	renamed.Duration += t.Duration
+	renamed.Focused += t.Focused
+	renamed.Unfocused += t.Unfocused
+	if t.DurationHistogram.Count > 0 {
+		renamed.DurationHistogram.add(t.DurationHistogram)
+	}
+	if t.FocusedHistogram.Count > 0 {
+		renamed.FocusedHistogram.add(t.FocusedHistogram)
+	}
+
+	e.SessionCount.WithLabelValues(labels...).Add(t.Sessions)
+	e.SessionDuration.WithLabelValues(labels...).Add(t.Duration)
+	e.SessionFocusedDuration.WithLabelValues(labels...).Add(t.Focused)
+	e.SessionUnfocusedDuration.WithLabelValues(labels...).Add(t.Unfocused)
+}
+
+// joinTags returns the tags as a single label value, such that each tag can be
+// matched with e.g. tags=~".*,team-a,.*".
+func joinTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+
+	return "," + strings.Join(sorted, ",") + ","
+}
+
+// placeholderLabels returns the label set of the zero-valued counters of a
+// dashboard, in which all but the dashboard labels are empty.
+func (e *Exporter) placeholderLabels(uid string, name string) []string {
+	labels := []string{"", "", name, uid, "", "", "", "", ""}
+	if e.userMetrics {
+		labels = append(labels, "", "")
+	}
+
+	return labels
+}
+
+func (e *Exporter) counters() []*prometheus.CounterVec {
+	return []*prometheus.CounterVec{
+		e.SessionCount,
+		e.SessionDuration,
+		e.SessionFocusedDuration,
+		e.SessionUnfocusedDuration,
+	}
+}
+
+func (e *Exporter) initPlaceholders(d inventory.Dashboard) {
+	labels := e.placeholderLabels(d.UID, d.Title)
+	for _, vec := range e.counters() {
+		vec.WithLabelValues(labels...)
+	}
+
+	e.ActiveSessions.WithLabelValues(d.Title, d.UID)
+	for _, w := range userWindows {
+		e.UniqueUsers.WithLabelValues(d.Title, d.UID, w.name)
+	}
+}
+
+func (e *Exporter) deletePlaceholders(uid string, name string) {
+	labels := e.placeholderLabels(uid, name)
+	for _, vec := range e.counters() {
+		vec.DeleteLabelValues(labels...)
+	}
+
+	e.ActiveSessions.DeleteLabelValues(name, uid)
+	for _, w := range userWindows {
+		e.UniqueUsers.DeleteLabelValues(name, uid, w.name)
+	}
+}
+
+// deleteDashboard removes all series and accumulated totals of a dashboard.
+// The dashboard's remaining sessions are ignored from then on, unless it
+// reappears in the inventory.
+func (e *Exporter) deleteDashboard(uid string, name string) {
+	e.deletePlaceholders(uid, name)
+	e.deleted[uid] = true
+
+	for key, t := range e.totals {
+		if t.Labels[3] != uid {
+			continue
+		}
+		for _, vec := range e.counters() {
+			vec.DeleteLabelValues(t.Labels...)
+		}
+		delete(e.totals, key)
+	}
+
+	delete(e.users, uid)
+}
@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultDurationBuckets are the default buckets for session duration
+// histograms, ranging from 10 seconds to 8 hours.
+var DefaultDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 28800}
+
+// Histogram holds the observations of a histogram for a label set. Unlike a
+// prometheus.Histogram, it can be persisted and restored.
+type Histogram struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	// Buckets holds the cumulative count for each upper bound.
+	Buckets []uint64 `json:"buckets"`
+}
+
+// observe adds a single observation to the histogram.
+func (h *Histogram) observe(upperBounds []float64, v float64) {
+	if len(h.Buckets) != len(upperBounds) {
+		h.Buckets = make([]uint64, len(upperBounds))
+	}
+
+	h.Count++
+	h.Sum += v
+	for i, upperBound := range upperBounds {
+		if v <= upperBound {
+			h.Buckets[i]++
+		}
+	}
+}
+
+// add adds the observations of another histogram with the same buckets.
+func (h *Histogram) add(o Histogram) {
+	if len(h.Buckets) != len(o.Buckets) {
+		h.Buckets = make([]uint64, len(o.Buckets))
+	}
+
+	h.Count += o.Count
+	h.Sum += o.Sum
+	for i, count := range o.Buckets {
+		h.Buckets[i] += count
+	}
+}
+
+// metric returns the histogram as a constant metric.
+func (h *Histogram) metric(desc *prometheus.Desc, upperBounds []float64, labels []string) (prometheus.Metric, error) {
+	buckets := make(map[float64]uint64, len(upperBounds))
+	for i, upperBound := range upperBounds {
+		if i < len(h.Buckets) {
+			buckets[upperBound] = h.Buckets[i]
+		} else {
+			buckets[upperBound] = 0
+		}
+	}
+
+	return prometheus.NewConstHistogram(desc, h.Count, h.Sum, buckets, labels...)
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// State is the persistable state of the Exporter's counters.
+type State struct {
+	Totals []Total `json:"totals"`
+	// Sessions holds the contribution of each stored session which has
+	// already been added to the totals.
+	Sessions map[string]Reported `json:"sessions"`
+	// Users holds the users who viewed each dashboard, by dashboard UID.
+	Users map[string]DashboardUsers `json:"users"`
+	// Views holds the most recent view of each dashboard, by dashboard UID.
+	Views map[string]View `json:"views"`
+}
+
+// Reported is the contribution of a stored session to the totals.
+type Reported struct {
+	Duration  float64 `json:"duration"`
+	Focused   float64 `json:"focused"`
+	Unfocused float64 `json:"unfocused"`
+	Observed  bool    `json:"observed"`
+}
+
+// Total holds the counter and histogram values for a label set.
+type Total struct {
+	Labels            []string  `json:"labels"`
+	Sessions          float64   `json:"sessions"`
+	Duration          float64   `json:"duration"`
+	Focused           float64   `json:"focused"`
+	Unfocused         float64   `json:"unfocused"`
+	DurationHistogram Histogram `json:"durationHistogram"`
+	FocusedHistogram  Histogram `json:"focusedHistogram"`
+}
+
+// State returns a copy of the Exporter's counters.
+func (e *Exporter) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := State{
+		Totals:   make([]Total, 0, len(e.totals)),
+		Sessions: make(map[string]Reported, len(e.sessions)),
+		Users:    make(map[string]DashboardUsers, len(e.users)),
+		Views:    make(map[string]View, len(e.views)),
+	}
+	for _, t := range e.totals {
+		s.Totals = append(s.Totals, *t)
+	}
+	for uuid, r := range e.sessions {
+		s.Sessions[uuid] = Reported{
+			Duration:  r.duration,
+			Focused:   r.focused,
+			Unfocused: r.unfocused,
+			Observed:  r.observed,
+		}
+	}
+	for uid, d := range e.users {
+		lastSeen := make(map[string]int64, len(d.LastSeen))
+		for key, ts := range d.LastSeen {
+			lastSeen[key] = ts
+		}
+		s.Users[uid] = DashboardUsers{Name: d.Name, LastSeen: lastSeen}
+	}
+	for uid, v := range e.views {
+		s.Views[uid] = v
+	}
+
+	return s
+}
+
+// Restore adds the counters from a previous State. It should be called
+// before the first scrape, and before the sessions stored at the same point
+// in time are restored, so that sessions evicted meanwhile are folded as
+// already counted.
+func (e *Exporter) Restore(s State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, t := range s.Totals {
+		sessionCount, err := e.SessionCount.GetMetricWithLabelValues(t.Labels...)
+		if err != nil {
+			// The label set differs, e.g. when user metrics have been toggled.
+			level.Warn(e.logger).Log("msg", "Skipped restoring counters", "labels", strings.Join(t.Labels, ","), "err", err)
+			continue
+		}
+		sessionCount.Add(t.Sessions)
+
+		total := e.total(t.Labels)
+		total.Sessions += t.Sessions
+
+		for _, c := range []struct {
+			vec      *prometheus.CounterVec
+			restored float64
+			total    *float64
+		}{
+			{e.SessionDuration, t.Duration, &total.Duration},
+			{e.SessionFocusedDuration, t.Focused, &total.Focused},
+			{e.SessionUnfocusedDuration, t.Unfocused, &total.Unfocused},
+		} {
+			if c.restored > 0 {
+				c.vec.WithLabelValues(t.Labels...).Add(c.restored)
+				*c.total += c.restored
+			}
+		}
+
+		// Histograms can only be restored with the same buckets.
+		for _, h := range []struct {
+			restored Histogram
+			total    *Histogram
+		}{
+			{t.DurationHistogram, &total.DurationHistogram},
+			{t.FocusedHistogram, &total.FocusedHistogram},
+		} {
+			if h.restored.Count == 0 {
+				continue
+			}
+			if len(h.restored.Buckets) != len(e.buckets) {
+				level.Warn(e.logger).Log("msg", "Skipped restoring histogram with different buckets", "labels", strings.Join(t.Labels, ","))
+				continue
+			}
+			h.total.add(h.restored)
+		}
+	}
+
+	for uuid, r := range s.Sessions {
+		e.sessions[uuid] = reported{
+			duration:  r.Duration,
+			focused:   r.Focused,
+			unfocused: r.Unfocused,
+			observed:  r.Observed,
+		}
+	}
+
+	for uid, d := range s.Users {
+		users, ok := e.users[uid]
+		if !ok {
+			users = &DashboardUsers{Name: d.Name, LastSeen: map[string]int64{}}
+			e.users[uid] = users
+		}
+		for key, ts := range d.LastSeen {
+			if ts > users.LastSeen[key] {
+				users.LastSeen[key] = ts
+			}
+		}
+	}
+
+	for uid, v := range s.Views {
+		if current, ok := e.views[uid]; !ok || v.Time.After(current.Time) {
+			e.views[uid] = v
+		}
+	}
+}
+
+// total returns the Total for a label set. It must be called while holding
+// the lock.
+func (e *Exporter) total(labels []string) *Total {
+	key := strings.Join(labels, "\xff")
+
+	t, ok := e.totals[key]
+	if !ok {
+		t = &Total{Labels: labels}
+		e.totals[key] = t
+	}
+
+	return t
+}
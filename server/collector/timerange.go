@@ -0,0 +1,245 @@
+package collector
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTimeRangeBuckets are the default buckets for time range spans,
+// ranging from 5 minutes to a year.
+var DefaultTimeRangeBuckets = []float64{
+	300, 900, 3600, 3 * 3600, 6 * 3600, 12 * 3600,
+	86400, 2 * 86400, 7 * 86400, 30 * 86400, 90 * 86400, 180 * 86400, 365 * 86400,
+}
+
+// TimeRangeExporter is an exporter for the time ranges used on dashboards.
+// Each time a session selects a different time range, it is counted once.
+// Payloads are counted as they are received, see Observe.
+type TimeRangeExporter struct {
+	Spans  *prometheus.HistogramVec
+	Ranges *prometheus.CounterVec
+
+	mu             sync.Mutex
+	sessions       map[string]string          // Session UUID to raw time range.
+	expressions    map[string]map[string]bool // Dashboard to relative expressions.
+	series         dashboardSeries
+	inventory      *inventory.Inventory
+	maxExpressions int
+	logger         log.Logger
+}
+
+// NewTimeRangeExporter creates a TimeRangeExporter. Once a dashboard has
+// maxExpressions distinct relative ranges, new ones are counted as
+// OtherValue. A maxExpressions of 0 means unlimited. The inventory may be nil.
+func NewTimeRangeExporter(inventory *inventory.Inventory, maxExpressions int, logger log.Logger) *TimeRangeExporter {
+	return &TimeRangeExporter{
+		Spans: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "time_range_seconds",
+				Help:      "Span of the time ranges selected on dashboards.",
+				Buckets:   DefaultTimeRangeBuckets,
+			},
+			[]string{"dashboard_name", "dashboard_uid"},
+		),
+		Ranges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "time_ranges_total",
+				Help:      "Number of times a time range was selected. Absolute ranges are counted without from and to.",
+			},
+			[]string{"dashboard_name", "dashboard_uid", "type", "from", "to"},
+		),
+		sessions:       map[string]string{},
+		expressions:    map[string]map[string]bool{},
+		series:         newDashboardSeries(),
+		inventory:      inventory,
+		maxExpressions: maxExpressions,
+		logger:         logger,
+	}
+}
+
+// Describe describes all metrics.
+func (e *TimeRangeExporter) Describe(ch chan<- *prometheus.Desc) {
+	e.Spans.Describe(ch)
+	e.Ranges.Describe(ch)
+}
+
+// Collect collects all metrics. The series of dashboards which were deleted
+// from the inventory are removed first.
+func (e *TimeRangeExporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	for _, uid := range e.series.sync(e.inventory) {
+		delete(e.expressions, uid)
+	}
+	e.mu.Unlock()
+
+	e.Spans.Collect(ch)
+	e.Ranges.Collect(ch)
+}
+
+// Observe counts the time range of a payload, if it differs from the range
+// of the session's previous payload.
+func (e *TimeRangeExporter) Observe(p payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.update(p.UUID, p)
+}
+
+// Fold stops tracking a session which is leaving the store.
+func (e *TimeRangeExporter) Fold(uuid string, _ payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.sessions, uuid)
+}
+
+// Track records the time range of a payload as the session's current range
+// without counting it, e.g. for payloads which were counted before a restart.
+func (e *TimeRangeExporter) Track(p payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tr := p.TimeRange
+	if tr.Raw.From == "" && tr.Raw.To == "" {
+		return
+	}
+
+	key := tr.Raw.From + "\xff" + tr.Raw.To
+	e.sessions[p.UUID] = key
+	if isRelative(tr.Raw.From) && isRelative(tr.Raw.To) {
+		e.allowExpression(p.Dashboard.UID, key)
+	}
+}
+
+// update counts the session's time range if it changed since the session's
+// previous payload. The raw range is compared, since the resolved range of
+// relative ranges moves with every payload.
+func (e *TimeRangeExporter) update(uuid string, p payload.Payload) {
+	tr := p.TimeRange
+	if tr.Raw.From == "" && tr.Raw.To == "" {
+		return
+	}
+
+	key := tr.Raw.From + "\xff" + tr.Raw.To
+	if e.sessions[uuid] == key {
+		return
+	}
+	e.sessions[uuid] = key
+
+	name := dashboardName(e.inventory, p.Dashboard)
+	if tr.To >= tr.From {
+		e.Spans.WithLabelValues(e.series.labels(e.Spans, name, p.Dashboard.UID)...).Observe(float64(tr.To - tr.From))
+	}
+
+	if isRelative(tr.Raw.From) && isRelative(tr.Raw.To) {
+		from, to := tr.Raw.From, tr.Raw.To
+		if !e.allowExpression(p.Dashboard.UID, key) {
+			from, to = OtherValue, OtherValue
+		}
+		e.Ranges.WithLabelValues(e.series.labels(e.Ranges, name, p.Dashboard.UID, "relative", from, to)...).Inc()
+	} else {
+		e.Ranges.WithLabelValues(e.series.labels(e.Ranges, name, p.Dashboard.UID, "absolute", "", "")...).Inc()
+	}
+}
+
+// allowExpression reports whether a relative range may be used as a label
+// value, or if the dashboard already has too many distinct ranges.
+func (e *TimeRangeExporter) allowExpression(dashboardUID string, key string) bool {
+	expressions, ok := e.expressions[dashboardUID]
+	if !ok {
+		expressions = map[string]bool{}
+		e.expressions[dashboardUID] = expressions
+	}
+
+	if expressions[key] {
+		return true
+	}
+	if e.maxExpressions != 0 && len(expressions) >= e.maxExpressions {
+		return false
+	}
+
+	expressions[key] = true
+	return true
+}
+
+// isRelative reports whether a raw time is relative, e.g. "now-6h" or "now/d".
+func isRelative(raw string) bool {
+	return strings.HasPrefix(raw, "now")
+}
+
+// RawRange is a raw time range, e.g. from "now-6h" to "now".
+type RawRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TimeRangeState is the persistable state of a TimeRangeExporter. The
+// counters themselves are not part of it.
+type TimeRangeState struct {
+	// Sessions holds the current range of each tracked session.
+	Sessions map[string]RawRange `json:"sessions"`
+	// Expressions holds the distinct relative ranges counted for each
+	// dashboard, by dashboard UID.
+	Expressions map[string][]RawRange `json:"expressions"`
+}
+
+// State returns a copy of the sessions and expressions tracked by the
+// TimeRangeExporter.
+func (e *TimeRangeExporter) State() TimeRangeState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := TimeRangeState{
+		Sessions:    make(map[string]RawRange, len(e.sessions)),
+		Expressions: make(map[string][]RawRange, len(e.expressions)),
+	}
+	for uuid, key := range e.sessions {
+		s.Sessions[uuid] = toRawRange(key)
+	}
+	for uid, expressions := range e.expressions {
+		for key := range expressions {
+			s.Expressions[uid] = append(s.Expressions[uid], toRawRange(key))
+		}
+	}
+
+	return s
+}
+
+// Restore adds the sessions and expressions from a previous State, so that
+// restored sessions are not counted again.
+func (e *TimeRangeExporter) Restore(s TimeRangeState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for uuid, r := range s.Sessions {
+		e.sessions[uuid] = r.From + "\xff" + r.To
+	}
+	for uid, ranges := range s.Expressions {
+		expressions, ok := e.expressions[uid]
+		if !ok {
+			expressions = map[string]bool{}
+			e.expressions[uid] = expressions
+		}
+		for _, r := range ranges {
+			expressions[r.From+"\xff"+r.To] = true
+		}
+	}
+}
+
+func toRawRange(key string) RawRange {
+	parts := strings.SplitN(key, "\xff", 2)
+	if len(parts) < 2 {
+		return RawRange{From: parts[0]}
+	}
+
+	return RawRange{From: parts[0], To: parts[1]}
+}
@@ -0,0 +1,104 @@
+package collector_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTimeRanges(t *testing.T) {
+	timeRangeCache := cacher.NewCache(0, 0)
+	timeRangeExporter := collector.NewTimeRangeExporter(nil, 1, logger)
+	timeRangeCache.OnEvicted(timeRangeExporter.Fold)
+
+	add := func(uuid string, from int, to int, rawFrom string, rawTo string) {
+		request := payloadtest.GetPayload(t)
+		request.UUID = uuid
+		request.Type = "heartbeat"
+		request.TimeRange.From = from
+		request.TimeRange.To = to
+		request.TimeRange.Raw.From = rawFrom
+		request.TimeRange.Raw.To = rawTo
+		payload.ProcessPayload(timeRangeCache, request, logger)
+		timeRangeExporter.Observe(request)
+	}
+
+	add("timerange1", 1600000000-6*3600, 1600000000, "now-6h", "now")
+	_ = testutil.CollectAndCount(timeRangeExporter)
+
+	// The resolved range of a relative range moves, but it is still the same range.
+	add("timerange1", 1600000060-6*3600, 1600000060, "now-6h", "now")
+	add("timerange2", 1600000000-7*86400, 1600000000, "now-7d", "now")
+	add("timerange3", 1600000000-1800, 1600000000, "2020-09-13T11:56:40.000Z", "2020-09-13T12:26:40.000Z")
+	timeRangeCache.Flush()
+
+	expected := `
+# HELP grafana_analytics_time_ranges_total Number of times a time range was selected. Absolute ranges are counted without from and to.
+# TYPE grafana_analytics_time_ranges_total counter
+grafana_analytics_time_ranges_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",from="",to="",type="absolute"} 1
+grafana_analytics_time_ranges_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",from="__other__",to="__other__",type="relative"} 1
+grafana_analytics_time_ranges_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",from="now-6h",to="now",type="relative"} 1
+`
+	err := testutil.CollectAndCompare(timeRangeExporter, strings.NewReader(expected), "grafana_analytics_time_ranges_total")
+	if err != nil {
+		t.Error(err)
+	}
+
+	count := testutil.CollectAndCount(timeRangeExporter, "grafana_analytics_time_range_seconds")
+	if count != 1 {
+		t.Errorf("Expected a single time range histogram, got '%d'", count)
+	}
+}
+
+func TestTimeRangesBetweenScrapes(t *testing.T) {
+	timeRangeExporter := collector.NewTimeRangeExporter(nil, 0, logger)
+
+	// Every change is counted, even if there is no scrape in between.
+	for _, raw := range []string{"now-1h", "now-6h", "now-1h"} {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "switching"
+		request.Type = "heartbeat"
+		request.TimeRange.Raw.From = raw
+		request.TimeRange.Raw.To = "now"
+		timeRangeExporter.Observe(request)
+	}
+
+	expected := `
+# HELP grafana_analytics_time_ranges_total Number of times a time range was selected. Absolute ranges are counted without from and to.
+# TYPE grafana_analytics_time_ranges_total counter
+grafana_analytics_time_ranges_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",from="now-1h",to="now",type="relative"} 2
+grafana_analytics_time_ranges_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",from="now-6h",to="now",type="relative"} 1
+`
+	err := testutil.CollectAndCompare(timeRangeExporter, strings.NewReader(expected), "grafana_analytics_time_ranges_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimeRangesDeletedDashboard(t *testing.T) {
+	dashboards := inventory.New(worker.Client{}, logger)
+	dashboards.Set([]inventory.Dashboard{{UID: "b_1UbypGz", Title: "New Dashboard 1234"}})
+	timeRangeExporter := collector.NewTimeRangeExporter(dashboards, 0, logger)
+	_ = testutil.CollectAndCount(timeRangeExporter)
+
+	request := payloadtest.GetPayload(t)
+	request.Type = "heartbeat"
+	request.TimeRange.Raw.From = "now-6h"
+	request.TimeRange.Raw.To = "now"
+	timeRangeExporter.Observe(request)
+	if count := testutil.CollectAndCount(timeRangeExporter, "grafana_analytics_time_ranges_total"); count == 0 {
+		t.Fatalf("Expected series for the dashboard")
+	}
+
+	dashboards.Set([]inventory.Dashboard{{UID: "other", Title: "Other"}})
+	if count := testutil.CollectAndCount(timeRangeExporter, "grafana_analytics_time_ranges_total"); count != 0 {
+		t.Errorf("Expected the series of the deleted dashboard to be removed, got '%d'", count)
+	}
+}
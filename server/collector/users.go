@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// userWindows are the windows over which unique users are counted.
+var userWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// DashboardUsers holds when each user last viewed a dashboard.
+type DashboardUsers struct {
+	Name string `json:"name"`
+	// LastSeen maps each user to a unix timestamp.
+	LastSeen map[string]int64 `json:"lastSeen"`
+}
+
+func newUniqueUsers() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "unique_users",
+			Help:      "Number of distinct users who viewed a dashboard within the window.",
+		},
+		[]string{"dashboard_name", "dashboard_uid", "window"},
+	)
+}
+
+// userKey identifies the user of a session by login, or by ID if the login
+// is not set.
+func userKey(u payload.UserInfo) string {
+	if u.Login != "" {
+		return u.Login
+	}
+
+	return "id:" + strconv.Itoa(u.ID)
+}
+
+// seeUser records the user of a session as having viewed its dashboard. It
+// must be called while holding the lock.
+func (e *Exporter) seeUser(p payload.Payload) {
+	d, ok := e.users[p.Dashboard.UID]
+	if !ok {
+		d = &DashboardUsers{LastSeen: map[string]int64{}}
+		e.users[p.Dashboard.UID] = d
+	}
+	d.Name = dashboardName(e.inventory, p.Dashboard)
+
+	key := userKey(p.User)
+	if lastSeen := p.GetLastSeen().Unix(); lastSeen > d.LastSeen[key] {
+		d.LastSeen[key] = lastSeen
+	}
+}
+
+// updateUniqueUsers sets the unique user gauges, and forgets users who have
+// not been seen within the largest window. It must be called while holding
+// the lock.
+func (e *Exporter) updateUniqueUsers(now time.Time) {
+	e.UniqueUsers.Reset()
+
+	largest := userWindows[len(userWindows)-1].duration
+	for uid, d := range e.users {
+		for key, lastSeen := range d.LastSeen {
+			if now.Sub(time.Unix(lastSeen, 0)) > largest {
+				delete(d.LastSeen, key)
+			}
+		}
+		if len(d.LastSeen) == 0 {
+			delete(e.users, uid)
+			continue
+		}
+
+		name := dashboardName(e.inventory, payload.DashboardInfo{UID: uid, Name: d.Name})
+		for _, w := range userWindows {
+			count := 0
+			for _, lastSeen := range d.LastSeen {
+				if now.Sub(time.Unix(lastSeen, 0)) <= w.duration {
+					count++
+				}
+			}
+			e.UniqueUsers.WithLabelValues(name, uid, w.name).Set(float64(count))
+		}
+	}
+}
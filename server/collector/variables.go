@@ -0,0 +1,288 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// AllValue is the value sent by the panel when "All" is selected.
+	AllValue = "$__all"
+	// OtherValue replaces values once a variable exceeds its value limit.
+	OtherValue = "__other__"
+)
+
+// VariableExporter is an opt-in exporter for template variable usage. Each
+// time a session's selection of a variable changes, every selected value is
+// counted once. Payloads are counted as they are received, see Observe.
+type VariableExporter struct {
+	Selections *prometheus.CounterVec
+
+	mu        sync.Mutex
+	sessions  map[string]map[string]string // Session UUID to variable to selection.
+	values    map[string]map[string]bool   // Dashboard and variable to values.
+	series    dashboardSeries
+	inventory *inventory.Inventory
+	allow     map[string]bool
+	deny      map[string]bool
+	maxValues int
+	logger    log.Logger
+}
+
+// NewVariableExporter creates a VariableExporter. If allow is not empty, only
+// the variables named in it are counted. Variables named in deny are never
+// counted. Once a variable has maxValues distinct values on a dashboard, new
+// values are counted as OtherValue. A maxValues of 0 means unlimited. The
+// inventory may be nil.
+func NewVariableExporter(inventory *inventory.Inventory, allow []string, deny []string, maxValues int, logger log.Logger) *VariableExporter {
+	toSet := func(names []string) map[string]bool {
+		set := make(map[string]bool, len(names))
+		for _, name := range names {
+			set[name] = true
+		}
+		return set
+	}
+
+	return &VariableExporter{
+		Selections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "variable_selections_total",
+				Help:      "Number of times a template variable value was selected.",
+			},
+			[]string{"dashboard_name", "dashboard_uid", "variable", "value", "selection"},
+		),
+		sessions:  map[string]map[string]string{},
+		values:    map[string]map[string]bool{},
+		series:    newDashboardSeries(),
+		inventory: inventory,
+		allow:     toSet(allow),
+		deny:      toSet(deny),
+		maxValues: maxValues,
+		logger:    logger,
+	}
+}
+
+// Describe describes all metrics.
+func (e *VariableExporter) Describe(ch chan<- *prometheus.Desc) {
+	e.Selections.Describe(ch)
+}
+
+// Collect collects all metrics. The series of dashboards which were deleted
+// from the inventory are removed first.
+func (e *VariableExporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	for _, uid := range e.series.sync(e.inventory) {
+		for key := range e.values {
+			if strings.HasPrefix(key, uid+"\xff") {
+				delete(e.values, key)
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.Selections.Collect(ch)
+}
+
+// Observe counts the selections of a payload which differ from the
+// selections of the session's previous payload.
+func (e *VariableExporter) Observe(p payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.update(p.UUID, p)
+}
+
+// Fold stops tracking a session which is leaving the store.
+func (e *VariableExporter) Fold(uuid string, _ payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.sessions, uuid)
+}
+
+// Track records the selections of a payload as the session's current
+// selections without counting them, e.g. for payloads which were counted
+// before a restart.
+func (e *VariableExporter) Track(p payload.Payload) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	selections := e.selections(p.UUID)
+	for _, v := range p.Variables {
+		if !e.included(v.Name) || len(v.Values) == 0 {
+			continue
+		}
+
+		values := sortedValues(v)
+		selections[v.Name] = strings.Join(values, "\xff")
+		for _, value := range values {
+			if value != AllValue {
+				e.limit(p.Dashboard.UID, v.Name, value)
+			}
+		}
+	}
+}
+
+// update counts the values of each variable whose selection changed since
+// the session's previous payload.
+func (e *VariableExporter) update(uuid string, p payload.Payload) {
+	selections := e.selections(uuid)
+
+	for _, v := range p.Variables {
+		if !e.included(v.Name) || len(v.Values) == 0 {
+			continue
+		}
+
+		values := sortedValues(v)
+		selection := strings.Join(values, "\xff")
+		if selections[v.Name] == selection {
+			continue
+		}
+		selections[v.Name] = selection
+
+		kind := "single"
+		if len(values) > 1 {
+			kind = "multi"
+		}
+
+		name := dashboardName(e.inventory, p.Dashboard)
+		for _, value := range values {
+			if value == AllValue {
+				e.Selections.WithLabelValues(e.series.labels(e.Selections, name, p.Dashboard.UID, v.Name, AllValue, "all")...).Inc()
+				continue
+			}
+
+			e.Selections.WithLabelValues(e.series.labels(e.Selections, name, p.Dashboard.UID, v.Name, e.limit(p.Dashboard.UID, v.Name, value), kind)...).Inc()
+		}
+	}
+}
+
+func (e *VariableExporter) selections(uuid string) map[string]string {
+	selections, ok := e.sessions[uuid]
+	if !ok {
+		selections = map[string]string{}
+		e.sessions[uuid] = selections
+	}
+
+	return selections
+}
+
+func sortedValues(v payload.VariablesInfo) []string {
+	values := make([]string, len(v.Values))
+	for i, value := range v.Values {
+		values[i] = fmt.Sprint(value)
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+func (e *VariableExporter) included(name string) bool {
+	if e.deny[name] {
+		return false
+	}
+
+	return len(e.allow) == 0 || e.allow[name]
+}
+
+// limit returns the value, or OtherValue if the variable already has too many
+// distinct values on the dashboard.
+func (e *VariableExporter) limit(dashboardUID string, name string, value string) string {
+	key := dashboardUID + "\xff" + name
+	values, ok := e.values[key]
+	if !ok {
+		values = map[string]bool{}
+		e.values[key] = values
+	}
+
+	if values[value] {
+		return value
+	}
+	if e.maxValues != 0 && len(values) >= e.maxValues {
+		return OtherValue
+	}
+
+	values[value] = true
+	return value
+}
+
+// VariableState is the persistable state of a VariableExporter. The counters
+// themselves are not part of it.
+type VariableState struct {
+	// Sessions holds the selected values of each variable, by session UUID.
+	Sessions map[string]map[string][]string `json:"sessions"`
+	// Values holds the distinct values counted for each variable, by
+	// dashboard UID and variable name.
+	Values map[string]map[string][]string `json:"values"`
+}
+
+// State returns a copy of the sessions and values tracked by the
+// VariableExporter.
+func (e *VariableExporter) State() VariableState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := VariableState{
+		Sessions: make(map[string]map[string][]string, len(e.sessions)),
+		Values:   map[string]map[string][]string{},
+	}
+	for uuid, selections := range e.sessions {
+		variables := make(map[string][]string, len(selections))
+		for name, selection := range selections {
+			variables[name] = strings.Split(selection, "\xff")
+		}
+		s.Sessions[uuid] = variables
+	}
+	for key, values := range e.values {
+		parts := strings.SplitN(key, "\xff", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		variables, ok := s.Values[parts[0]]
+		if !ok {
+			variables = map[string][]string{}
+			s.Values[parts[0]] = variables
+		}
+		for value := range values {
+			variables[parts[1]] = append(variables[parts[1]], value)
+		}
+	}
+
+	return s
+}
+
+// Restore adds the sessions and values from a previous State, so that
+// restored sessions are not counted again.
+func (e *VariableExporter) Restore(s VariableState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for uuid, variables := range s.Sessions {
+		selections := e.selections(uuid)
+		for name, values := range variables {
+			selections[name] = strings.Join(values, "\xff")
+		}
+	}
+	for uid, variables := range s.Values {
+		for name, restored := range variables {
+			key := uid + "\xff" + name
+			values, ok := e.values[key]
+			if !ok {
+				values = map[string]bool{}
+				e.values[key] = values
+			}
+			for _, value := range restored {
+				values[value] = true
+			}
+		}
+	}
+}
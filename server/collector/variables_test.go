@@ -0,0 +1,94 @@
+package collector_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVariableSelections(t *testing.T) {
+	variableCache := cacher.NewCache(0, 0)
+	variableExporter := collector.NewVariableExporter(nil, nil, []string{"textBox"}, 1, logger)
+	variableCache.OnEvicted(variableExporter.Fold)
+
+	add := func(uuid string, customSingle string) {
+		request := payloadtest.GetPayload(t)
+		request.UUID = uuid
+		request.Type = "heartbeat"
+		request.Variables[3].Values = []interface{}{customSingle}
+		payload.ProcessPayload(variableCache, request, logger)
+		variableExporter.Observe(request)
+	}
+
+	add("variables1", "value1")
+	add("variables2", "value1")
+
+	// Unchanged selections are not counted again, and values beyond the limit
+	// are counted as other.
+	add("variables1", "value1")
+	add("variables2", "value2")
+	variableCache.Flush()
+
+	expected := `
+# HELP grafana_analytics_variable_selections_total Number of times a template variable value was selected.
+# TYPE grafana_analytics_variable_selections_total counter
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="all",value="$__all",variable="customMultiAll"} 2
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="single",value="__other__",variable="customSingle"} 1
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="single",value="constantValue",variable="constant"} 2
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="single",value="value1",variable="customSingle"} 2
+`
+	err := testutil.CollectAndCompare(variableExporter, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVariableSelectionsBetweenScrapes(t *testing.T) {
+	variableExporter := collector.NewVariableExporter(nil, []string{"customSingle"}, nil, 0, logger)
+
+	// Every change is counted, even if there is no scrape in between.
+	for _, value := range []string{"a", "b", "a"} {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "switching"
+		request.Type = "heartbeat"
+		request.Variables[3].Values = []interface{}{value}
+		variableExporter.Observe(request)
+	}
+
+	expected := `
+# HELP grafana_analytics_variable_selections_total Number of times a template variable value was selected.
+# TYPE grafana_analytics_variable_selections_total counter
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="single",value="a",variable="customSingle"} 2
+grafana_analytics_variable_selections_total{dashboard_name="New Dashboard 1234",dashboard_uid="b_1UbypGz",selection="single",value="b",variable="customSingle"} 1
+`
+	err := testutil.CollectAndCompare(variableExporter, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVariableSelectionsDeletedDashboard(t *testing.T) {
+	dashboards := inventory.New(worker.Client{}, logger)
+	dashboards.Set([]inventory.Dashboard{{UID: "b_1UbypGz", Title: "New Dashboard 1234"}})
+	variableExporter := collector.NewVariableExporter(dashboards, nil, nil, 0, logger)
+	_ = testutil.CollectAndCount(variableExporter)
+
+	request := payloadtest.GetPayload(t)
+	request.Type = "heartbeat"
+	variableExporter.Observe(request)
+	if count := testutil.CollectAndCount(variableExporter, "grafana_analytics_variable_selections_total"); count == 0 {
+		t.Fatalf("Expected series for the dashboard")
+	}
+
+	dashboards.Set([]inventory.Dashboard{{UID: "other", Title: "Other"}})
+	if count := testutil.CollectAndCount(variableExporter, "grafana_analytics_variable_selections_total"); count != 0 {
+		t.Errorf("Expected the series of the deleted dashboard to be removed, got '%d'", count)
+	}
+}
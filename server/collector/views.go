@@ -0,0 +1,47 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+)
+
+// View is the most recent view of a dashboard.
+type View struct {
+	Name  string    `json:"name"`
+	Login string    `json:"login"`
+	Time  time.Time `json:"time"`
+}
+
+// LastViews returns the most recent view of each dashboard, by dashboard UID.
+// Unlike the unique users, views are never forgotten.
+func (e *Exporter) LastViews() map[string]View {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Sessions which have not been scraped yet are included.
+	e.store.Range(func(_ string, p payload.Payload) bool {
+		e.seeView(p)
+		return true
+	})
+
+	views := make(map[string]View, len(e.views))
+	for uid, v := range e.views {
+		views[uid] = v
+	}
+
+	return views
+}
+
+// seeView records a session as a view of its dashboard. It must be called
+// while holding the lock.
+func (e *Exporter) seeView(p payload.Payload) {
+	lastSeen := p.GetLastSeen()
+	if v, ok := e.views[p.Dashboard.UID]; !ok || lastSeen.After(v.Time) {
+		e.views[p.Dashboard.UID] = View{
+			Name:  dashboardName(e.inventory, p.Dashboard),
+			Login: userKey(p.User),
+			Time:  lastSeen,
+		}
+	}
+}
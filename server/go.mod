@@ -5,8 +5,7 @@ go 1.16
 require (
 	github.com/alecthomas/kong v0.2.16
 	github.com/go-kit/kit v0.10.0
-	github.com/google/uuid v1.0.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/prometheus/client_golang v1.10.0
 	github.com/prometheus/common v0.20.0
+	gopkg.in/yaml.v2 v2.3.0
 )
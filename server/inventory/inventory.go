@@ -0,0 +1,154 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// GeneralFolder is the title of the folder dashboards are in by default.
+const GeneralFolder = worker.GeneralFolder
+
+// Dashboard is a dashboard which exists in Grafana.
+type Dashboard struct {
+	UID         string   `json:"uid"`
+	Title       string   `json:"title"`
+	FolderUID   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+	Tags        []string `json:"tags"`
+}
+
+// Inventory holds the dashboards which exist in Grafana, so that metrics can
+// be initialized for dashboards without any sessions.
+type Inventory struct {
+	mu         sync.Mutex
+	api        worker.Client
+	dashboards []Dashboard
+	titles     map[string]string // Dashboard UID to title.
+	loaded     bool
+	logger     log.Logger
+}
+
+// New creates an empty Inventory, which is loaded from Grafana by Refresh.
+func New(api worker.Client, logger log.Logger) *Inventory {
+	return &Inventory{
+		api:    api,
+		logger: logger,
+	}
+}
+
+// Refresh replaces the inventory with the dashboards currently in Grafana.
+// If Grafana cannot be reached, the previous inventory is kept.
+func (i *Inventory) Refresh() error {
+	response, hasErrored := i.api.GetDashboards()
+	if hasErrored {
+		return errors.New("Failed to get dashboards from Grafana")
+	}
+
+	var dashboards []Dashboard
+	for _, d := range response {
+		if !i.api.Selector.Matches(d) {
+			continue
+		}
+
+		folderTitle := d.FolderTitle
+		if folderTitle == "" {
+			folderTitle = GeneralFolder
+		}
+
+		dashboards = append(dashboards, Dashboard{
+			UID:         d.Uid,
+			Title:       d.Title,
+			FolderUID:   d.FolderUid,
+			FolderTitle: folderTitle,
+			Tags:        d.Tags,
+		})
+	}
+	i.Set(dashboards)
+
+	level.Debug(i.logger).Log("msg", "Refreshed dashboard inventory", "dashboards", len(dashboards))
+	return nil
+}
+
+// Set replaces the inventory with the given dashboards.
+func (i *Inventory) Set(dashboards []Dashboard) {
+	sorted := make([]Dashboard, len(dashboards))
+	copy(sorted, dashboards)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].UID < sorted[b].UID
+	})
+
+	titles := make(map[string]string, len(sorted))
+	for _, d := range sorted {
+		titles[d.UID] = d.Title
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.dashboards = sorted
+	i.titles = titles
+	i.loaded = true
+}
+
+// Title returns the current title of a dashboard, if it is in the inventory.
+func (i *Inventory) Title(uid string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	title, ok := i.titles[uid]
+	return title, ok
+}
+
+// Dashboards returns the dashboards sorted by UID. It returns false if the
+// inventory has never been loaded, in which case nothing is known about which
+// dashboards exist.
+func (i *Inventory) Dashboards() ([]Dashboard, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	dashboards := make([]Dashboard, len(i.dashboards))
+	copy(dashboards, i.dashboards)
+
+	return dashboards, i.loaded
+}
+
+// ServeHTTP refreshes the inventory on POST, and responds with the number of
+// dashboards in it.
+func (i *Inventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := i.Refresh()
+	if err != nil {
+		level.Error(i.logger).Log("msg", "Failed to refresh dashboard inventory", "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	dashboards, _ := i.Dashboards()
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"dashboards\":%d}\n", len(dashboards))
+}
+
+// StartRefresher refreshes the inventory at the given interval.
+func StartRefresher(i *Inventory, interval time.Duration, logger log.Logger) {
+	for {
+		time.Sleep(interval)
+
+		err := i.Refresh()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to refresh dashboard inventory", "err", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package inventory_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestRefresh(t *testing.T) {
+	search := []worker.DashboardsResponse{
+		{Uid: "b", Title: "B", Type: "dash-db"},
+		{Uid: "a", Title: "A", Type: "dash-db", FolderUid: "team", FolderTitle: "Team", Tags: []string{"prod"}},
+	}
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(search)
+	}))
+	defer grafana.Close()
+
+	i := inventory.New(worker.Client{GrafanaUrl: grafana.URL, Logger: logger}, logger)
+	if _, loaded := i.Dashboards(); loaded {
+		t.Errorf("Expected the inventory not to be loaded before the first refresh")
+	}
+
+	testserver := httptest.NewServer(i)
+	defer testserver.Close()
+
+	resp, err := http.Post(testserver.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	dashboards, loaded := i.Dashboards()
+	if !loaded || len(dashboards) != 2 || dashboards[0].UID != "a" {
+		t.Fatalf("Expected dashboards a and b, got %+v", dashboards)
+	}
+	if dashboards[0].FolderTitle != "Team" || len(dashboards[0].Tags) != 1 {
+		t.Errorf("Expected dashboard a in folder Team with a tag, got %+v", dashboards[0])
+	}
+	if dashboards[1].FolderTitle != inventory.GeneralFolder {
+		t.Errorf("Expected dashboard b in the general folder, got %+v", dashboards[1])
+	}
+
+	search[0].Title = "Renamed"
+	err = i.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title, _ := i.Title("b"); title != "Renamed" {
+		t.Errorf("Expected the renamed title, got %s", title)
+	}
+
+	grafana.Close()
+	if err := i.Refresh(); err == nil {
+		t.Errorf("Expected an error when Grafana is unreachable")
+	}
+	if dashboards, _ := i.Dashboards(); len(dashboards) != 2 {
+		t.Errorf("Expected the previous inventory to be kept, got %+v", dashboards)
+	}
+}
+
+func TestRefreshSelector(t *testing.T) {
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]worker.DashboardsResponse{
+			{Uid: "a", Title: "A", Type: "dash-db", Tags: []string{"sensitive"}},
+			{Uid: "b", Title: "B", Type: "dash-db"},
+		})
+	}))
+	defer grafana.Close()
+
+	selector, err := worker.ParseSelector(nil, []string{"tag=sensitive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := inventory.New(worker.Client{GrafanaUrl: grafana.URL, Logger: logger, Selector: selector}, logger)
+	err = i.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dashboards, _ := i.Dashboards(); len(dashboards) != 1 || dashboards[0].UID != "b" {
+		t.Errorf("Expected only dashboard b, got %+v", dashboards)
+	}
+}
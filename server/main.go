@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MacroPower/macropower-analytics-panel/server/api"
 	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
 	"github.com/MacroPower/macropower-analytics-panel/server/collector"
-	"github.com/MacroPower/macropower-analytics-panel/server/initializer"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
 	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/persister"
+	"github.com/MacroPower/macropower-analytics-panel/server/report"
 	"github.com/MacroPower/macropower-analytics-panel/server/worker"
 	"github.com/alecthomas/kong"
 	"github.com/go-kit/kit/log"
@@ -14,24 +21,53 @@ import (
 	"github.com/prometheus/common/version"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 )
 
 var (
 	cli struct {
-		HTTPAddress          string        `help:"Address to listen on for payloads and metrics." env:"HTTP_ADDRESS" default:":8080"`
-		SessionTimeout       time.Duration `help:"The maximum duration that may be added between heartbeats. 0 = auto." type:"time.Duration" env:"SESSION_TIMEOUT" default:"0"`
-		MaxCacheSize         int           `help:"The maximum number of sessions to store in the cache before resetting. 0 = unlimited." env:"MAX_CACHE_SIZE" default:"100000"`
-		LogFormat            string        `help:"One of: [logfmt, json]." env:"LOG_FORMAT" enum:"logfmt,json" default:"logfmt"`
-		LogRaw               bool          `help:"Outputs raw payloads as they are received." env:"LOG_RAW"`
-		DisableUserMetrics   bool          `help:"Disables user labels in metrics." env:"DISABLE_USER_METRICS"`
-		DisableSessionLog    bool          `help:"Disables logging sessions to the console." env:"DISABLE_SESSION_LOG"`
-		DisableVariableLog   bool          `help:"Disables logging variables to the console." env:"DISABLE_VARIABLE_LOG"`
-		DashboardUpdateToken string        `help:"Grafana token for updating dashboards." env:"DASHBOARD_UPDATE_TOKEN"`
-		GrafanaUrl           string        `help:"Grafana base URL, which is separate from analytics." env:"GRAFANA_URL"`
-		Timeout              string        `help:"Timeout for auto analytic adder interval" env:"TIMEOUT" default:"24" `
-		DashboardFilter      string        `help:"Update only single dashboard matching this name, useful to test analytics adder" env:"DASHBOARD_FILTER"`
+		HTTPAddress              string        `help:"Address to listen on for payloads and metrics." env:"HTTP_ADDRESS" default:":8080"`
+		SessionTimeout           time.Duration `help:"The maximum duration that may be added between heartbeats, and after which sessions without heartbeats are inactive. 0 = auto." type:"time.Duration" env:"SESSION_TIMEOUT" default:"0"`
+		MaxCacheSize             int           `help:"The maximum number of sessions to store in the cache. The least recently updated sessions are evicted first. 0 = unlimited." env:"MAX_CACHE_SIZE" default:"100000"`
+		SessionTTL               time.Duration `help:"The duration after which idle sessions are evicted from the cache. 0 = never." type:"time.Duration" env:"SESSION_TTL" default:"24h"`
+		LogFormat                string        `help:"One of: [logfmt, json]." env:"LOG_FORMAT" enum:"logfmt,json" default:"logfmt"`
+		LogRaw                   bool          `help:"Outputs raw payloads as they are received." env:"LOG_RAW"`
+		DisableUserMetrics       bool          `help:"Disables user labels in metrics and user data in the API and reports." env:"DISABLE_USER_METRICS"`
+		DisableSessionLog        bool          `help:"Disables logging sessions to the console." env:"DISABLE_SESSION_LOG"`
+		DisableVariableLog       bool          `help:"Disables logging variables to the console." env:"DISABLE_VARIABLE_LOG"`
+		DashboardUpdateToken     string        `help:"Grafana token for updating dashboards." env:"DASHBOARD_UPDATE_TOKEN"`
+		GrafanaUrl               string        `help:"Grafana base URL, which is separate from analytics." env:"GRAFANA_URL"`
+		Timeout                  string        `help:"Timeout for auto analytic adder interval" env:"TIMEOUT" default:"24" `
+		DashboardFilter          string        `help:"Update only single dashboard matching this name, useful to test analytics adder" env:"DASHBOARD_FILTER"`
+		DashboardInclude         []string      `help:"Only patch and list dashboards matching any of these selectors (field=value or field=~regex, where field is one of uid, title, folder, folder_uid, tag). Empty = all." env:"DASHBOARD_INCLUDE" sep:";"`
+		DashboardExclude         []string      `help:"Never patch or list dashboards matching any of these selectors." env:"DASHBOARD_EXCLUDE" sep:";"`
+		PanelTemplate            string        `help:"JSON or YAML file defining the analytics panel added to dashboards. $__analytics_url and $__panel_id are replaced. Empty = built-in panel." env:"PANEL_TEMPLATE"`
+		AnalyticsUrl             string        `help:"Public URL of this server as reachable from browsers, e.g. http://analytics:8080, which replaces $__analytics_url. Empty = http-address." env:"ANALYTICS_URL"`
+		ReconcileOptions         []string      `help:"Options of existing analytics panels to update to their value in the panel template, e.g. postEnd,heartbeatInterval. Reconciling server requires analytics-url. Empty = existing panels are left alone." env:"RECONCILE_OPTIONS"`
+		InventoryRefreshInterval time.Duration `help:"The interval at which the dashboards are listed from Grafana. 0 = only at startup and on demand." type:"time.Duration" env:"INVENTORY_REFRESH_INTERVAL" default:"10m"`
+		StoragePath              string        `help:"Directory to persist sessions in, so they survive restarts. Empty = disabled." env:"STORAGE_PATH"`
+		SnapshotInterval         time.Duration `help:"The interval at which sessions are snapshotted to the storage path." type:"time.Duration" env:"SNAPSHOT_INTERVAL" default:"5m"`
+		DurationBuckets          []float64     `help:"Buckets (in seconds) for the session duration histograms." env:"DURATION_BUCKETS" default:"10,30,60,120,300,600,1800,3600,7200,14400,28800"`
+		DisableTimeRangeMetrics  bool          `help:"Disables metrics for the time ranges used on dashboards." env:"DISABLE_TIME_RANGE_METRICS"`
+		TimeRangeMaxExpressions  int           `help:"The maximum number of distinct relative time ranges counted per dashboard. 0 = unlimited." env:"TIME_RANGE_MAX_EXPRESSIONS" default:"50"`
+		VariableMetrics          bool          `help:"Enables metrics for template variable usage." env:"VARIABLE_METRICS"`
+		VariableAllow            []string      `help:"Only count these template variables. Empty = all." env:"VARIABLE_ALLOW"`
+		VariableDeny             []string      `help:"Never count these template variables." env:"VARIABLE_DENY"`
+		VariableMaxValues        int           `help:"The maximum number of distinct values counted per variable and dashboard. 0 = unlimited." env:"VARIABLE_MAX_VALUES" default:"100"`
+
+		DryRun     bool   `help:"Only report the changes the dashboard patcher would make, without saving dashboards." env:"DRY_RUN"`
+		AdminToken string `help:"Bearer token required to use the /patch-dashboards and /remove-panels endpoints. Empty = these endpoints are disabled." env:"ADMIN_TOKEN"`
+
+		Serve            struct{} `cmd:"" default:"1" help:"Run the server (default)."`
+		PatchDashboards  struct{} `cmd:"" help:"Add analytics panels to dashboards once, and write the results."`
+		RemovePanels     struct{} `cmd:"" help:"Remove all analytics panels from dashboards, and write the results."`
+		UnusedDashboards struct {
+			Days   int    `help:"The number of days after which dashboards are unused." default:"90"`
+			Format string `help:"One of: [text, json]." enum:"text,json" default:"text"`
+		} `cmd:"" help:"Report dashboards not viewed within the given number of days, using the sessions in the storage path."`
 	}
 )
 
@@ -42,7 +78,11 @@ func main() {
 		kong.Description("A receiver for the macropower-analytics-panel Grafana plugin."),
 	)
 
+	// Reports are written to stdout, so their logs are written to stderr.
 	logWriter := log.NewSyncWriter(os.Stdout)
+	if ctx.Command() != "serve" {
+		logWriter = log.NewSyncWriter(os.Stderr)
+	}
 	logger := func() log.Logger {
 		if cli.LogFormat == "json" || cli.LogRaw {
 			return log.NewJSONLogger(logWriter)
@@ -51,6 +91,50 @@ func main() {
 		return log.NewLogfmtLogger(logWriter)
 	}()
 
+	analyticsUrl := cli.AnalyticsUrl
+	if analyticsUrl == "" {
+		analyticsUrl = cli.HTTPAddress
+	}
+
+	workerClient := worker.Client{
+		GrafanaUrl:   cli.GrafanaUrl,
+		Token:        cli.DashboardUpdateToken,
+		AnalyticsUrl: analyticsUrl,
+		Logger:       logger,
+		Filter:       cli.DashboardFilter,
+		Reconcile:    cli.ReconcileOptions,
+	}
+
+	if len(cli.DashboardInclude) > 0 || len(cli.DashboardExclude) > 0 {
+		selector, err := worker.ParseSelector(cli.DashboardInclude, cli.DashboardExclude)
+		ctx.FatalIfErrorf(err)
+		workerClient.Selector = selector
+	}
+
+	if cli.PanelTemplate != "" {
+		template, err := worker.LoadPanelTemplate(cli.PanelTemplate)
+		ctx.FatalIfErrorf(err)
+		workerClient.Template = template
+	}
+	ctx.FatalIfErrorf(workerClient.CheckReconcile())
+
+	switch ctx.Command() {
+	case "unused-dashboards":
+		err := reportUnusedDashboards(workerClient, logger)
+		ctx.FatalIfErrorf(err)
+		return
+	case "patch-dashboards":
+		results, err := workerClient.AddAnalyticsToDashboards(cli.DryRun)
+		ctx.FatalIfErrorf(err)
+		ctx.FatalIfErrorf(writeResults(results))
+		return
+	case "remove-panels":
+		results, err := workerClient.RemoveAnalyticsFromDashboards(cli.DryRun)
+		ctx.FatalIfErrorf(err)
+		ctx.FatalIfErrorf(writeResults(results))
+		return
+	}
+
 	level.Info(logger).Log(
 		"msg", "Starting server for macropower-analytics-panel",
 		"version", version.Version,
@@ -64,34 +148,99 @@ func main() {
 		"date", version.BuildDate,
 	)
 
-	cache := cacher.NewCache()
-	if cli.MaxCacheSize != 0 {
-		go cacher.StartFlusher(cache, cli.MaxCacheSize, logger)
+	cache := cacher.NewCache(cli.MaxCacheSize, cli.SessionTTL)
+	if cli.SessionTTL != 0 {
+		janitorInterval := time.Minute
+		if cli.SessionTTL < janitorInterval {
+			janitorInterval = cli.SessionTTL
+		}
+		go cacher.StartJanitor(cache, janitorInterval, logger)
 	}
 
 	mux := http.NewServeMux()
 
-	handler := payload.NewHandler(cache, 10, !cli.DisableSessionLog, !cli.DisableVariableLog, cli.LogRaw, logger)
-	mux.Handle("/write", handler)
+	// Without Grafana, series only exist for dashboards with sessions.
+	var dashboards *inventory.Inventory
+	if cli.GrafanaUrl != "" {
+		dashboards = inventory.New(workerClient, logger)
+		if err := dashboards.Refresh(); err != nil {
+			level.Error(logger).Log("msg", "Failed to load dashboard inventory", "err", err)
+		}
+		if cli.InventoryRefreshInterval != 0 {
+			go inventory.StartRefresher(dashboards, cli.InventoryRefreshInterval, logger)
+		}
+	}
 
 	exporter := version.NewCollector("grafana_analytics")
-	metricExporter := collector.NewExporter(cache, cli.SessionTimeout, !cli.DisableUserMetrics, logger)
-	prometheus.MustRegister(exporter, metricExporter)
-	mux.Handle("/metrics", promhttp.Handler())
+	metricExporter := collector.NewExporter(cache, dashboards, cli.SessionTimeout, !cli.DisableUserMetrics, cli.DurationBuckets, logger)
+	collectors := []prometheus.Collector{exporter, metricExporter, cache}
+	folds := []func(string, payload.Payload){metricExporter.Fold}
+	var observers []payload.Observer
 
-	workerClient := worker.Client{
-		GrafanaUrl:   cli.GrafanaUrl,
-		Token:        cli.DashboardUpdateToken,
-		AnalyticsUrl: cli.HTTPAddress,
-		Logger:       logger,
-		Filter:       cli.DashboardFilter,
+	var timeRangeExporter *collector.TimeRangeExporter
+	if !cli.DisableTimeRangeMetrics {
+		timeRangeExporter = collector.NewTimeRangeExporter(dashboards, cli.TimeRangeMaxExpressions, logger)
+		collectors = append(collectors, timeRangeExporter)
+		folds = append(folds, timeRangeExporter.Fold)
+		observers = append(observers, timeRangeExporter)
+	}
+
+	var variableExporter *collector.VariableExporter
+	if cli.VariableMetrics {
+		variableExporter = collector.NewVariableExporter(dashboards, cli.VariableAllow, cli.VariableDeny, cli.VariableMaxValues, logger)
+		collectors = append(collectors, variableExporter)
+		folds = append(folds, variableExporter.Fold)
+		observers = append(observers, variableExporter)
 	}
 
-	mux.HandleFunc("/patch-dashboards", func(w http.ResponseWriter, r *http.Request) {
-		workerClient.AddAnalyticsToDashboards()
+	cache.OnEvicted(func(uuid string, p payload.Payload) {
+		for _, fold := range folds {
+			fold(uuid, p)
+		}
 	})
 
-	initializer.InitializeMetricsForDashboards(workerClient, logger, cache)
+	var journal payload.Journal
+	if cli.StoragePath != "" {
+		store, err := persister.New(cli.StoragePath, cache, metricExporter, timeRangeExporter, variableExporter, logger)
+		ctx.FatalIfErrorf(err)
+
+		err = store.Restore()
+		ctx.FatalIfErrorf(err)
+
+		go persister.StartSnapshotter(store, cli.SnapshotInterval, logger)
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			<-sig
+
+			if err := store.Snapshot(); err != nil {
+				level.Error(logger).Log("msg", "Failed to write snapshot", "err", err)
+			}
+			store.Close()
+			os.Exit(0)
+		}()
+
+		journal = store
+	}
+
+	handler := payload.NewHandler(cache, journal, observers, 10, !cli.DisableSessionLog, !cli.DisableVariableLog, cli.LogRaw, logger)
+	mux.Handle("/write", handler)
+	mux.Handle("/api/", api.NewHandler(cache, cli.SessionTimeout, !cli.DisableUserMetrics, logger))
+	mux.Handle("/grafana/", api.NewDatasource("/grafana", cache, cli.SessionTimeout, !cli.DisableUserMetrics, logger))
+
+	prometheus.MustRegister(collectors...)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	if dashboards != nil {
+		mux.Handle("/inventory/refresh", dashboards)
+	}
+	mux.Handle("/reports/unused-dashboards", report.NewHandler(workerClient, metricExporter, !cli.DisableUserMetrics, logger))
+	// These endpoints change dashboards with the update token, while this
+	// listener must be reachable by every browser viewing a dashboard.
+	if cli.AdminToken != "" {
+		mux.Handle("/patch-dashboards", requireToken(cli.AdminToken, patchHandler(workerClient.AddAnalyticsToDashboards)))
+		mux.Handle("/remove-panels", requireToken(cli.AdminToken, patchHandler(workerClient.RemoveAnalyticsFromDashboards)))
+	}
 
 	timeout, err := strconv.Atoi(cli.Timeout)
 	if err != nil {
@@ -108,10 +257,95 @@ func main() {
 
 	go func() {
 		for range ticker.C {
-			workerClient.AddAnalyticsToDashboards()
+			_, err := workerClient.AddAnalyticsToDashboards(cli.DryRun)
+			if err != nil {
+				level.Error(logger).Log("msg", "Failed to patch dashboards", "err", err)
+			}
 		}
 	}()
 
 	err = http.ListenAndServe(cli.HTTPAddress, mux)
 	ctx.FatalIfErrorf(err)
 }
+
+// patchHandler runs patch on POST requests and responds with its results. The
+// dry-run query parameter overrides the dry-run flag.
+func patchHandler(patch func(dryRun bool) ([]worker.PatchResult, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		dryRun := cli.DryRun
+		if v := r.URL.Query().Get("dry-run"); v != "" {
+			var err error
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid value for dry-run: %s", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		results, err := patch(dryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(results)
+	})
+}
+
+// requireToken only passes requests with the given bearer token to next.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeResults writes the results of patching dashboards to stdout.
+func writeResults(results []worker.PatchResult) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// reportUnusedDashboards writes the unused dashboard report to stdout, using
+// the sessions and views persisted in the storage path.
+func reportUnusedDashboards(api worker.Client, logger log.Logger) error {
+	if cli.StoragePath == "" {
+		return errors.New("A storage path is required to report unused dashboards")
+	}
+
+	cache := cacher.NewCache(0, 0)
+	metricExporter := collector.NewExporter(cache, nil, cli.SessionTimeout, !cli.DisableUserMetrics, cli.DurationBuckets, logger)
+
+	err := persister.Load(cli.StoragePath, cache, metricExporter, logger)
+	if err != nil {
+		return err
+	}
+
+	dashboards, hasErrored := api.GetDashboards()
+	if hasErrored {
+		return errors.New("Failed to get dashboards from Grafana")
+	}
+
+	since := time.Now().AddDate(0, 0, -cli.UnusedDashboards.Days)
+	r := report.Unused(dashboards, metricExporter.LastViews(), since, !cli.DisableUserMetrics)
+	if cli.UnusedDashboards.Format == "json" {
+		return r.WriteJSON(os.Stdout)
+	}
+
+	return r.WriteText(os.Stdout)
+}
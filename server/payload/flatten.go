@@ -0,0 +1,88 @@
+package payload
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// isFlattenSeparator reports whether r separates path segments in a flattened
+// payload. The panel uses dots, while tools like Telegraf use underscores. No
+// payload field contains either, so both can be accepted at once.
+func isFlattenSeparator(r rune) bool {
+	return r == '.' || r == '_'
+}
+
+// unflattenPayload rebuilds a nested payload from a flattened one. It returns
+// false if b is not a flattened payload.
+func unflattenPayload(b []byte) ([]byte, bool, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, false, nil
+	}
+
+	flattened := false
+	for k := range keys {
+		if strings.IndexFunc(k, isFlattenSeparator) >= 0 {
+			flattened = true
+			break
+		}
+	}
+	if !flattened {
+		return nil, false, nil
+	}
+
+	root := map[string]interface{}{}
+	for k, raw := range keys {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, true, err
+		}
+
+		parts := strings.FieldsFunc(k, isFlattenSeparator)
+		if len(parts) == 0 {
+			continue
+		}
+
+		node := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+
+	nested, err := json.Marshal(restoreArrays(root))
+	return nested, true, err
+}
+
+// restoreArrays replaces objects keyed by consecutive indexes with arrays.
+func restoreArrays(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	for k, child := range m {
+		m[k] = restoreArrays(child)
+	}
+
+	if len(m) == 0 {
+		return m
+	}
+
+	list := make([]interface{}, len(m))
+	for k, child := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(m) || strconv.Itoa(i) != k {
+			return m
+		}
+		list[i] = child
+	}
+
+	return list
+}
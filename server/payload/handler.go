@@ -1,26 +1,39 @@
 package payload
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
-	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
 
+// Journal records payloads after they have been applied to the store, so
+// that they can be replayed after a restart.
+type Journal interface {
+	Append(p Payload) error
+}
+
+// Observer is notified of every payload applied to the store, e.g. to count
+// changes of which the store only keeps the latest state.
+type Observer interface {
+	Observe(p Payload)
+}
+
 // Handler is the handler for incoming payloads.
 type Handler struct {
 	logger log.Logger
 	ch     chan Payload
 }
 
-// NewHandler creates a new Handler.
-func NewHandler(cache *cacher.Cacher, buffer int, sessionLog bool, variableLog bool, raw bool, logger log.Logger) *Handler {
+// NewHandler creates a new Handler. The journal may be nil.
+func NewHandler(store SessionStore, journal Journal, observers []Observer, buffer int, sessionLog bool, variableLog bool, raw bool, logger log.Logger) *Handler {
 	ch := make(chan Payload, buffer)
-	go startProcessor(cache, ch, sessionLog, variableLog, raw, logger)
+	go startProcessor(store, journal, observers, ch, sessionLog, variableLog, raw, logger)
 
 	return &Handler{
 		logger: logger,
@@ -28,26 +41,150 @@ func NewHandler(cache *cacher.Cacher, buffer int, sessionLog bool, variableLog b
 	}
 }
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p := Payload{}
+// MaxBodySize is the largest request body accepted, in bytes.
+const MaxBodySize = 10 << 20
 
-	err := json.NewDecoder(r.Body).Decode(&p)
+// BatchResult is the response body for requests containing multiple payloads.
+type BatchResult struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Errors   []BatchError `json:"errors,omitempty"`
+}
+
+// BatchError describes a payload that was rejected from a batch.
+type BatchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// ServeHTTP accepts a single payload, a JSON array of payloads, or
+// newline-delimited JSON payloads. Bodies larger than MaxBodySize are
+// rejected.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
 	if err != nil {
+		// The body is only read up to the limit if it is too large.
+		if len(body) >= MaxBodySize {
+			http.Error(w, "", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
-	h.ch <- p
+	items, batch := splitBatch(body)
+	if !batch {
+		p, err := decodePayload(body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		h.ch <- p
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "")
+		return
+	}
+
+	result := BatchResult{}
+	for i, item := range items {
+		p, err := decodePayload(item)
+		if err != nil {
+			result.Rejected++
+			result.Errors = append(result.Errors, BatchError{Index: i, Error: err.Error()})
+			continue
+		}
+
+		h.ch <- p
+		result.Accepted++
+	}
+
+	status := http.StatusCreated
+	if result.Accepted == 0 && result.Rejected > 0 {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// splitBatch splits a request body into its raw payloads. It returns false
+// when the body contains a single payload.
+func splitBatch(body []byte) ([][]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return [][]byte{trimmed}, true
+		}
+
+		batch := make([][]byte, len(items))
+		for i, item := range items {
+			batch[i] = item
+		}
+		return batch, true
+	}
+
+	// A single payload may still span several lines, so only treat the body as
+	// NDJSON if it holds more than one JSON value.
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	var first json.RawMessage
+	if err := dec.Decode(&first); err == nil && !dec.More() {
+		return nil, false
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprint(w, "")
+	var batch [][]byte
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		batch = append(batch, line)
+	}
+	if len(batch) < 2 {
+		return nil, false
+	}
+
+	return batch, true
+}
+
+// decodePayload decodes a single raw payload, which may be flattened.
+func decodePayload(b []byte) (Payload, error) {
+	p := Payload{}
+
+	nested, flattened, err := unflattenPayload(b)
+	if err != nil {
+		return p, err
+	}
+	if flattened {
+		b = nested
+	}
+
+	err = json.Unmarshal(b, &p)
+	return p, err
 }
 
 // startProcessor starts a receiver and optional logger for the Payload channel.
-func startProcessor(cache *cacher.Cacher, c <-chan Payload, sessionLog bool, variableLog bool, raw bool, logger log.Logger) {
+func startProcessor(store SessionStore, journal Journal, observers []Observer, c <-chan Payload, sessionLog bool, variableLog bool, raw bool, logger log.Logger) {
 	for p := range c {
 		if p.Dashboard.UID != "new" {
-			ProcessPayload(cache, p, logger)
+			ProcessPayload(store, p, logger)
+			for _, o := range observers {
+				o.Observe(p)
+			}
+
+			if journal != nil {
+				if err := journal.Append(p); err != nil {
+					_ = level.Warn(logger).Log(
+						"msg", "Failed to journal payload",
+						"uuid", p.UUID,
+						"err", err,
+					)
+				}
+			}
 		}
 		if sessionLog {
 			LogPayload(p, variableLog, logger, raw)
@@ -55,17 +192,17 @@ func startProcessor(cache *cacher.Cacher, c <-chan Payload, sessionLog bool, var
 	}
 }
 
-// processPayload is a receiver for Payloads.
-func ProcessPayload(cache *cacher.Cacher, p Payload, logger log.Logger) {
+// ProcessPayload applies a Payload to the session store.
+func ProcessPayload(store SessionStore, p Payload, logger log.Logger) {
 	switch p.Type {
 	case "start":
-		addStart(cache, p)
+		addStart(store, p)
 	case "heartbeat":
-		addHeartbeat(cache, p)
+		addHeartbeat(store, p)
 	case "end":
-		addEnd(cache, p)
+		addEnd(store, p)
 	default:
-		addHeartbeat(cache, p)
+		addHeartbeat(store, p)
 		_ = level.Warn(logger).Log(
 			"msg", "Session has invalid type, defaulted to heartbeat",
 			"uuid", p.UUID,
@@ -1,6 +1,9 @@
 package payload_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -14,11 +17,11 @@ import (
 var (
 	logBuffer = payloadtest.SafeBuffer{}
 	logger    = log.NewJSONLogger(log.NewSyncWriter(&logBuffer))
-	cache     = cacher.NewCache()
+	cache     = cacher.NewCache(0, 0)
 )
 
 func newTestServer() *httptest.Server {
-	handler := payload.NewHandler(cache, 10, true, true, true, logger)
+	handler := payload.NewHandler(cache, nil, nil, 10, true, true, true, logger)
 	testserver := httptest.NewServer(handler)
 
 	return testserver
@@ -57,11 +60,10 @@ func TestPayloadLifecycle(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	p1, exists := cache.Get("test")
+	p, exists := cache.Get("test")
 	if !exists {
 		t.Fatal("Expected cache to contain item for payload")
 	}
-	p := p1.(payload.Payload)
 	actual := p.GetDuration(time.Duration(0))
 	expected := 2 * time.Hour
 	if expected != actual {
@@ -102,11 +104,10 @@ func TestPayloadHeartbeat(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	p1, exists := cache.Get("test")
+	p, exists := cache.Get("test")
 	if !exists {
 		t.Fatal("Expected cache to contain item for payload")
 	}
-	p := p1.(payload.Payload)
 
 	// Gathering the duration should have no side effects.
 	_ = p.GetDuration(time.Duration(0))
@@ -124,3 +125,151 @@ func TestPayloadHeartbeat(t *testing.T) {
 	t.Log(logBuffer.String())
 	logBuffer.Reset()
 }
+
+func TestBatchArray(t *testing.T) {
+	testserver := newTestServer()
+	defer testserver.Close()
+
+	request1 := payloadtest.GetPayload(t)
+	request1.UUID = "batch-array"
+	request1.Type = "start"
+	request1.Time = 1600000000
+
+	request2 := payloadtest.GetPayload(t)
+	request2.UUID = "batch-array"
+	request2.Type = "end"
+	request2.Time = 1600000600
+
+	items := []interface{}{request1, "not a payload", request2}
+	body, err := json.Marshal(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := payloadtest.SendBatch(t, testserver.URL, body)
+	if result.Accepted != 2 || result.Rejected != 1 {
+		t.Errorf("Expected 2 accepted and 1 rejected, got %d and %d", result.Accepted, result.Rejected)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 1 {
+		t.Errorf("Expected an error for index 1, got %v", result.Errors)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	p, exists := cache.Get("batch-array")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	actual := p.GetDuration(time.Duration(0))
+	expected := 10 * time.Minute
+	if expected != actual {
+		t.Errorf("Expected the duration '%s', got '%s'\n", expected.String(), actual.String())
+	}
+
+	logBuffer.Reset()
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	testserver := newTestServer()
+	defer testserver.Close()
+
+	body := bytes.Repeat([]byte(" "), payload.MaxBodySize+1)
+	resp, err := http.Post(testserver.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func TestBatchNDJSON(t *testing.T) {
+	testserver := newTestServer()
+	defer testserver.Close()
+
+	var body bytes.Buffer
+	for i, eventType := range []string{"start", "heartbeat", "end"} {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "batch-ndjson"
+		request.Type = eventType
+		request.Time = 1600000000 + i*60
+
+		line, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Write(line)
+		body.WriteString("\n")
+	}
+	body.WriteString("{\"uuid\": 1}\n")
+
+	result := payloadtest.SendBatch(t, testserver.URL, body.Bytes())
+	if result.Accepted != 3 || result.Rejected != 1 {
+		t.Errorf("Expected 3 accepted and 1 rejected, got %d and %d", result.Accepted, result.Rejected)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	p, exists := cache.Get("batch-ndjson")
+	if !exists {
+		t.Fatal("Expected cache to contain item for payload")
+	}
+	actual := p.GetDuration(time.Duration(0))
+	expected := 2 * time.Minute
+	if expected != actual {
+		t.Errorf("Expected the duration '%s', got '%s'\n", expected.String(), actual.String())
+	}
+
+	logBuffer.Reset()
+}
+
+func TestFlattenedPayload(t *testing.T) {
+	testserver := newTestServer()
+	defer testserver.Close()
+
+	for _, sep := range []string{".", "_"} {
+		request := payloadtest.GetPayload(t)
+		request.UUID = "flattened" + sep
+		request.Type = "start"
+		request.Time = 1600000000
+
+		body, err := json.Marshal(payloadtest.Flatten(t, request, sep))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Post(testserver.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Received non-201 response: %d\n", resp.StatusCode)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	expected := payloadtest.GetPayload(t)
+	for _, sep := range []string{".", "_"} {
+		p, exists := cache.Get("flattened" + sep)
+		if !exists {
+			t.Fatalf("Expected cache to contain item for payload flattened with '%s'", sep)
+		}
+
+		if p.Dashboard != expected.Dashboard || p.User != expected.User || p.TimeRange != expected.TimeRange {
+			t.Errorf("Expected payload flattened with '%s' to match the nested payload, got %+v", sep, p)
+		}
+		if len(p.Variables) != len(expected.Variables) {
+			t.Fatalf("Expected %d variables, got %d", len(expected.Variables), len(p.Variables))
+		}
+		for i, v := range p.Variables {
+			if v.Name != expected.Variables[i].Name || len(v.Values) != len(expected.Variables[i].Values) {
+				t.Errorf("Expected variable %+v, got %+v", expected.Variables[i], v)
+			}
+		}
+	}
+
+	logBuffer.Reset()
+}
@@ -3,12 +3,8 @@ package payload
 import (
 	"sort"
 	"time"
-
-	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
 )
 
-const ANALYTICS_USER = "grafana-analytics"
-
 // Payload is the body expected on /write.
 type Payload struct {
 	UUID       string          `json:"uuid"`
@@ -27,6 +23,11 @@ type Payload struct {
 	startTime      time.Time
 	heartbeatTimes []time.Time
 	endTime        time.Time
+
+	// The focus reported with each event, with heartbeatFocus matching heartbeatTimes.
+	startFocus     bool
+	heartbeatFocus []bool
+	endFocus       bool
 }
 
 type TimeRangeInfo struct {
@@ -99,45 +100,95 @@ type HostBuildInfo struct {
 	Edition string `json:"edition"`
 }
 
-// addStart sets the payload StartTime and adds it to the cache.
-func addStart(cache *cacher.Cacher, p Payload) {
+// Record is a Payload along with its session times, used to persist sessions.
+type Record struct {
+	Payload        Payload     `json:"payload"`
+	StartTime      time.Time   `json:"startTime"`
+	HeartbeatTimes []time.Time `json:"heartbeatTimes,omitempty"`
+	EndTime        time.Time   `json:"endTime"`
+	StartFocus     bool        `json:"startFocus"`
+	HeartbeatFocus []bool      `json:"heartbeatFocus,omitempty"`
+	EndFocus       bool        `json:"endFocus"`
+}
+
+// NewRecord creates a Record for the Payload.
+func NewRecord(p Payload) Record {
+	return Record{
+		Payload:        p,
+		StartTime:      p.startTime,
+		HeartbeatTimes: p.heartbeatTimes,
+		EndTime:        p.endTime,
+		StartFocus:     p.startFocus,
+		HeartbeatFocus: p.heartbeatFocus,
+		EndFocus:       p.endFocus,
+	}
+}
+
+// Restore returns the Payload with its session times set from the Record.
+func (r Record) Restore() Payload {
+	p := r.Payload
+	p.startTime = r.StartTime
+	p.heartbeatTimes = r.HeartbeatTimes
+	p.endTime = r.EndTime
+	p.startFocus = r.StartFocus
+	p.heartbeatFocus = r.HeartbeatFocus
+	p.endFocus = r.EndFocus
+
+	return p
+}
+
+// addStart sets the payload StartTime and adds it to the store.
+func addStart(store SessionStore, p Payload) {
 	ts := time.Unix(int64(p.Time), 0)
 	p.startTime = ts
-	cache.Add(p.UUID, p, cacher.Expiration)
+	p.startFocus = p.HasFocus
+
+	store.Upsert(p.UUID, func(p1 Payload, exists bool) Payload {
+		if exists {
+			return p1
+		}
+		return p
+	})
 }
 
-// addHeartbeat sets the payload HeartbeatTime and sets it in the cache.
-func addHeartbeat(cache *cacher.Cacher, p Payload) {
+// addHeartbeat sets the payload HeartbeatTime and sets it in the store.
+func addHeartbeat(store SessionStore, p Payload) {
 	ts := time.Unix(int64(p.Time), 0)
 
-	cp, exists := cache.Get(p.UUID)
-	if exists {
-		p1 := cp.(Payload)
-		p.heartbeatTimes = append(p1.heartbeatTimes, ts)
-		p.startTime = p1.startTime
-	} else {
-		p.heartbeatTimes = []time.Time{ts}
-		p.startTime = ts
-	}
-
-	cache.Set(p.UUID, p, cacher.Expiration)
+	store.Upsert(p.UUID, func(p1 Payload, exists bool) Payload {
+		if exists {
+			p.heartbeatTimes = append(p1.heartbeatTimes, ts)
+			p.heartbeatFocus = append(p1.heartbeatFocus, p.HasFocus)
+			p.startTime = p1.startTime
+			p.startFocus = p1.startFocus
+		} else {
+			p.heartbeatTimes = []time.Time{ts}
+			p.heartbeatFocus = []bool{p.HasFocus}
+			p.startTime = ts
+			p.startFocus = p.HasFocus
+		}
+		return p
+	})
 }
 
-// addEnd sets the payload EndTime and sets it in the cache.
-func addEnd(cache *cacher.Cacher, p Payload) {
+// addEnd sets the payload EndTime and sets it in the store.
+func addEnd(store SessionStore, p Payload) {
 	ts := time.Unix(int64(p.Time), 0)
 	p.endTime = ts
+	p.endFocus = p.HasFocus
 
-	cp, exists := cache.Get(p.UUID)
-	if exists {
-		p1 := cp.(Payload)
-		p.heartbeatTimes = p1.heartbeatTimes
-		p.startTime = p1.startTime
-	} else {
-		p.startTime = ts
-	}
-
-	cache.Set(p.UUID, p, cacher.Expiration)
+	store.Upsert(p.UUID, func(p1 Payload, exists bool) Payload {
+		if exists {
+			p.heartbeatTimes = p1.heartbeatTimes
+			p.heartbeatFocus = p1.heartbeatFocus
+			p.startTime = p1.startTime
+			p.startFocus = p1.startFocus
+		} else {
+			p.startTime = ts
+			p.startFocus = p.HasFocus
+		}
+		return p
+	})
 }
 
 // IsTimeSet returns a bool for each time element representing the set status.
@@ -149,51 +200,128 @@ func (p Payload) IsTimeSet() (start bool, heartbeat bool, end bool) {
 	return start, heartbeat, end
 }
 
+// autoTimeout returns the timeout derived from the session's heartbeat interval.
+func (p Payload) autoTimeout() time.Duration {
+	timeout := time.Duration(p.Options.HeartbeatInterval) * time.Second
+	return timeout + timeout/4
+}
+
+// GetStartTime returns the time the session started.
+func (p Payload) GetStartTime() time.Time {
+	return p.startTime
+}
+
+// GetEndTime returns the time the session ended, which is zero if it has not.
+func (p Payload) GetEndTime() time.Time {
+	return p.endTime
+}
+
+// GetLastSeen returns the time of the session's start, latest heartbeat or end.
+func (p Payload) GetLastSeen() time.Time {
+	lastSeen := p.startTime
+	for _, hb := range p.heartbeatTimes {
+		if hb.After(lastSeen) {
+			lastSeen = hb
+		}
+	}
+	if p.endTime.After(lastSeen) {
+		lastSeen = p.endTime
+	}
+
+	return lastSeen
+}
+
+// IsActive returns true if the session has not ended, and was started or sent
+// a heartbeat within the timeout before now. A timeout of 0 is derived from
+// the heartbeat interval, as in GetDuration.
+func (p Payload) IsActive(now time.Time, timeout time.Duration) bool {
+	startSet, _, endSet := p.IsTimeSet()
+	if !startSet || endSet {
+		return false
+	}
+
+	if timeout == 0 {
+		timeout = p.autoTimeout()
+	}
+
+	return now.Sub(p.GetLastSeen()) <= timeout
+}
+
 // GetDuration returns the calculated duration of the session.
 func (p Payload) GetDuration(max time.Duration) time.Duration {
+	focused, unfocused := p.getDurations(max)
+	return focused + unfocused
+}
+
+// GetFocusedDuration returns the part of the session's duration during which
+// the dashboard had focus.
+func (p Payload) GetFocusedDuration(max time.Duration) time.Duration {
+	focused, _ := p.getDurations(max)
+	return focused
+}
+
+type event struct {
+	time  time.Time
+	focus bool
+}
+
+// getDurations returns the calculated duration of the session, split by
+// focus. Each interval between two events is attributed to the focus
+// reported with the event that ends it.
+func (p Payload) getDurations(max time.Duration) (focused time.Duration, unfocused time.Duration) {
 	zeroDuration := time.Duration(0)
 
+	add := func(d time.Duration, focus bool) {
+		if focus {
+			focused += d
+		} else {
+			unfocused += d
+		}
+	}
+
 	startSet, hbSet, endSet := p.IsTimeSet()
 	if !startSet {
-		return zeroDuration
+		return zeroDuration, zeroDuration
 	}
 
 	if hbSet {
 		if max == zeroDuration {
-			max = time.Duration(p.Options.HeartbeatInterval) * time.Second
-			max += max / 4
+			max = p.autoTimeout()
 		}
 
-		hbs := make([]time.Time, len(p.heartbeatTimes))
-		copy(hbs, p.heartbeatTimes)
-		hbs = append(hbs, p.startTime)
+		events := make([]event, 0, len(p.heartbeatTimes)+2)
+		for i, hb := range p.heartbeatTimes {
+			events = append(events, event{time: hb, focus: p.heartbeatFocus[i]})
+		}
+		events = append(events, event{time: p.startTime, focus: p.startFocus})
 		if endSet {
-			hbs = append(hbs, p.endTime)
+			events = append(events, event{time: p.endTime, focus: p.endFocus})
 		}
-		sort.SliceStable(hbs, func(i, j int) bool {
-			return hbs[i].Before(hbs[j])
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].time.Before(events[j].time)
 		})
 
-		duration := zeroDuration
-		for i, hb := range hbs[1:] {
-			durationDiff := hb.Sub(hbs[i])
+		for i, ev := range events[1:] {
+			durationDiff := ev.time.Sub(events[i].time)
 			if durationDiff < max {
-				duration += durationDiff
+				add(durationDiff, ev.focus)
 			} else {
-				duration += max
+				add(max, ev.focus)
 			}
 		}
-		return duration
+		return focused, unfocused
 	}
 
 	if !endSet {
-		return zeroDuration
+		return zeroDuration, zeroDuration
 	}
 
 	totalTime := p.endTime.Sub(p.startTime)
 	if max == zeroDuration || totalTime < max {
-		return totalTime
+		add(totalTime, p.endFocus)
+	} else {
+		add(max, p.endFocus)
 	}
 
-	return max
+	return focused, unfocused
 }
@@ -0,0 +1,16 @@
+package payload
+
+// SessionStore stores sessions by UUID.
+type SessionStore interface {
+	// Get returns the session with the given UUID.
+	Get(uuid string) (Payload, bool)
+	// Upsert stores the result of update, which receives the current session
+	// and whether it exists. The read and write happen atomically.
+	Upsert(uuid string, update func(p Payload, exists bool) Payload)
+	// Range calls f for each session until f returns false.
+	Range(f func(uuid string, p Payload) bool)
+	// Delete removes the session with the given UUID.
+	Delete(uuid string)
+	// Count returns the number of sessions.
+	Count() int
+}
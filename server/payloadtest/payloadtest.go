@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"path"
 	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 
@@ -91,3 +92,66 @@ func SendPayload(t *testing.T, url string, p payload.Payload) {
 		t.Errorf("Expected the message '%s'\n", expected)
 	}
 }
+
+// SendBatch sends a raw batch body to the provided test server
+func SendBatch(t *testing.T, url string, body []byte) (result payload.BatchResult) {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+// Flatten returns the payload with nested keys joined by sep, as done by the
+// panel's flatten option
+func Flatten(t *testing.T, p payload.Payload, sep string) map[string]interface{} {
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nested interface{}
+	err = json.Unmarshal(b, &nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flat := map[string]interface{}{}
+	flatten(flat, "", sep, nested)
+	return flat
+}
+
+func flatten(flat map[string]interface{}, prefix string, sep string, v interface{}) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + sep + k
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			flat[prefix] = value
+		}
+		for k, child := range value {
+			flatten(flat, join(k), sep, child)
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			flat[prefix] = value
+		}
+		for i, child := range value {
+			flatten(flat, join(strconv.Itoa(i)), sep, child)
+		}
+	default:
+		flat[prefix] = value
+	}
+}
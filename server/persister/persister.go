@@ -0,0 +1,303 @@
+package persister
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "payloads.log"
+)
+
+// Snapshot is the persisted state of the session store and the exporter.
+type Snapshot struct {
+	Time     time.Time        `json:"time"`
+	Sessions []payload.Record `json:"sessions"`
+	Exporter collector.State  `json:"exporter"`
+
+	TimeRanges *collector.TimeRangeState `json:"timeRanges,omitempty"`
+	Variables  *collector.VariableState  `json:"variables,omitempty"`
+}
+
+// Persister stores session state in a directory, as a periodic snapshot plus
+// an append-only log of the payloads applied since that snapshot.
+type Persister struct {
+	mu       sync.Mutex
+	dir      string
+	journal  *os.File
+	store    payload.SessionStore
+	exporter *collector.Exporter
+	logger   log.Logger
+
+	timeRanges *collector.TimeRangeExporter
+	variables  *collector.VariableExporter
+}
+
+// New creates a Persister using dir, which is created if it does not exist.
+// The time range and variable exporters may be nil.
+func New(dir string, store payload.SessionStore, exporter *collector.Exporter, timeRanges *collector.TimeRangeExporter, variables *collector.VariableExporter, logger log.Logger) (*Persister, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Persister{
+		dir:      dir,
+		store:    store,
+		exporter: exporter,
+		logger:   logger,
+
+		timeRanges: timeRanges,
+		variables:  variables,
+	}, nil
+}
+
+// Load restores the snapshot and journal in dir into the store and exporter,
+// for read-only use of a storage path. Unlike a Persister, it does not create
+// the directory or open the journal for writing.
+func Load(dir string, store payload.SessionStore, exporter *collector.Exporter, logger log.Logger) error {
+	p := &Persister{
+		dir:      dir,
+		store:    store,
+		exporter: exporter,
+		logger:   logger,
+	}
+
+	return p.load()
+}
+
+// Restore loads the snapshot and replays the journal, and then opens the
+// journal for appending. It must be called before any payloads are appended.
+func (p *Persister) Restore() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.load()
+	if err != nil {
+		return err
+	}
+
+	p.journal, err = os.OpenFile(filepath.Join(p.dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// load restores the snapshot and replays the journal.
+func (p *Persister) load() error {
+	snapshot, err := p.readSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// The exporter is restored first, so that sessions evicted while restoring
+	// the store are folded as already counted, rather than counted again.
+	p.exporter.Restore(snapshot.Exporter)
+	if p.timeRanges != nil && snapshot.TimeRanges != nil {
+		p.timeRanges.Restore(*snapshot.TimeRanges)
+	}
+	if p.variables != nil && snapshot.Variables != nil {
+		p.variables.Restore(*snapshot.Variables)
+	}
+
+	// Sessions are stored in the order they were ranged over, which for the
+	// in-memory store retains the eviction order.
+	for _, r := range snapshot.Sessions {
+		s := r.Restore()
+		p.store.Upsert(s.UUID, func(payload.Payload, bool) payload.Payload {
+			return s
+		})
+	}
+
+	replayed, err := p.replayJournal()
+	if err != nil {
+		return err
+	}
+
+	level.Info(p.logger).Log(
+		"msg", "Restored sessions from disk",
+		"snapshot_time", snapshot.Time,
+		"sessions", len(snapshot.Sessions),
+		"replayed", replayed,
+	)
+
+	return nil
+}
+
+// Append writes a payload to the journal. Payloads applied between a
+// snapshot and the truncation of the journal may be replayed twice, which is
+// harmless since repeated heartbeats at the same time add no duration.
+func (p *Persister) Append(pl payload.Payload) error {
+	b, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.journal == nil {
+		return errors.New("Journal is not open")
+	}
+
+	_, err = p.journal.Write(append(b, '\n'))
+	return err
+}
+
+// Snapshot writes the current state to disk and truncates the journal.
+func (p *Persister) Snapshot() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The exporter state is read first. Sessions evicted in between are then
+	// missing from both, rather than being counted twice after a restore.
+	snapshot := Snapshot{
+		Time:     time.Now(),
+		Exporter: p.exporter.State(),
+	}
+	if p.timeRanges != nil {
+		s := p.timeRanges.State()
+		snapshot.TimeRanges = &s
+	}
+	if p.variables != nil {
+		s := p.variables.State()
+		snapshot.Variables = &s
+	}
+
+	p.store.Range(func(_ string, s payload.Payload) bool {
+		snapshot.Sessions = append(snapshot.Sessions, payload.NewRecord(s))
+		return true
+	})
+
+	err := p.writeSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if p.journal != nil {
+		err = p.journal.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the journal.
+func (p *Persister) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.journal == nil {
+		return nil
+	}
+
+	err := p.journal.Close()
+	p.journal = nil
+	return err
+}
+
+func (p *Persister) readSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{}
+
+	b, err := ioutil.ReadFile(filepath.Join(p.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(b, &snapshot)
+	return snapshot, err
+}
+
+// writeSnapshot writes to a temporary file first, so a crash never leaves a
+// partially written snapshot behind.
+func (p *Persister) writeSnapshot(snapshot Snapshot) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(p.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(p.dir, snapshotFile))
+}
+
+// replayJournal applies all payloads in the journal to the store. A partially
+// written last line, e.g. after a crash, is skipped.
+func (p *Persister) replayJournal() (int, error) {
+	f, err := os.Open(filepath.Join(p.dir, journalFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		pl := payload.Payload{}
+		err := json.Unmarshal(scanner.Bytes(), &pl)
+		if err != nil {
+			level.Warn(p.logger).Log("msg", "Skipped invalid journal entry", "err", err)
+			continue
+		}
+
+		payload.ProcessPayload(p.store, pl, p.logger)
+
+		// Payloads in the journal were counted before the restart, so they
+		// are only tracked.
+		if p.timeRanges != nil {
+			p.timeRanges.Track(pl)
+		}
+		if p.variables != nil {
+			p.variables.Track(pl)
+		}
+		replayed++
+	}
+
+	return replayed, scanner.Err()
+}
+
+// StartSnapshotter writes a snapshot at the given interval.
+func StartSnapshotter(p *Persister, interval time.Duration, logger log.Logger) {
+	for {
+		time.Sleep(interval)
+
+		err := p.Snapshot()
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to write snapshot", "err", err)
+		}
+	}
+}
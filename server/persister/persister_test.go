@@ -0,0 +1,269 @@
+package persister_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/persister"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func newPersister(t *testing.T, dir string, maxSize int) (*persister.Persister, *cacher.Cacher, *collector.Exporter) {
+	cache := cacher.NewCache(maxSize, 0)
+	exporter := collector.NewExporter(cache, nil, time.Duration(0), true, nil, logger)
+	cache.OnEvicted(exporter.Fold)
+
+	p, err := persister.New(dir, cache, exporter, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, cache, exporter
+}
+
+func scrape(c prometheus.Collector) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	for range ch {
+	}
+}
+
+func apply(t *testing.T, p *persister.Persister, cache *cacher.Cacher, uuid string, eventType string, ts int) {
+	request := payloadtest.GetPayload(t)
+	request.UUID = uuid
+	request.Type = eventType
+	request.Time = ts
+
+	payload.ProcessPayload(cache, request, logger)
+	err := p.Append(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p1, cache1, exporter1 := newPersister(t, dir, 0)
+
+	apply(t, p1, cache1, "snapshotted", "start", 1600000000)
+	apply(t, p1, cache1, "snapshotted", "end", 1600000600)
+	apply(t, p1, cache1, "evicted", "end", 1600000000)
+
+	// The evicted session only survives in the exporter counters.
+	scrape(exporter1)
+	evicted, _ := cache1.Get("evicted")
+	cache1.Delete("evicted")
+	exporter1.Fold("evicted", evicted)
+
+	err = p1.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply(t, p1, cache1, "journaled", "start", 1600000000)
+	apply(t, p1, cache1, "journaled", "end", 1600000060)
+	err = p1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cache2, exporter2 := newPersister(t, dir, 0)
+
+	expectedDurations := map[string]time.Duration{
+		"snapshotted": 10 * time.Minute,
+		"journaled":   time.Minute,
+	}
+	for uuid, expected := range expectedDurations {
+		p, exists := cache2.Get(uuid)
+		if !exists {
+			t.Fatalf("Expected cache to contain restored session '%s'", uuid)
+		}
+		actual := p.GetDuration(time.Duration(0))
+		if expected != actual {
+			t.Errorf("Expected the duration '%s' for '%s', got '%s'", expected.String(), uuid, actual.String())
+		}
+	}
+
+	scrape(exporter2)
+	state := exporter2.State()
+	if len(state.Totals) != 1 {
+		t.Fatalf("Expected a single label set, got %v", state.Totals)
+	}
+	if state.Totals[0].Sessions != 3 {
+		t.Errorf("Expected '3' sessions, got '%v'", state.Totals[0].Sessions)
+	}
+	if state.Totals[0].Duration != 660 {
+		t.Errorf("Expected '660' seconds, got '%v'", state.Totals[0].Duration)
+	}
+}
+
+func TestRestoreSmallerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p1, cache1, exporter1 := newPersister(t, dir, 0)
+	apply(t, p1, cache1, "first", "end", 1600000000)
+	apply(t, p1, cache1, "second", "end", 1600000000)
+	scrape(exporter1)
+
+	err = p1.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring into a smaller cache evicts the first session.
+	_, cache2, exporter2 := newPersister(t, dir, 1)
+	if _, exists := cache2.Get("first"); exists {
+		t.Fatalf("Expected the first session to be evicted")
+	}
+
+	scrape(exporter2)
+	state := exporter2.State()
+	if len(state.Totals) != 1 || state.Totals[0].Sessions != 2 {
+		t.Errorf("Expected '2' sessions, got %v", state.Totals)
+	}
+}
+
+func TestRestoreTimeRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newTimeRangePersister := func() (*persister.Persister, *collector.TimeRangeExporter) {
+		cache := cacher.NewCache(0, 0)
+		exporter := collector.NewExporter(cache, nil, time.Duration(0), true, nil, logger)
+		timeRanges := collector.NewTimeRangeExporter(nil, 0, logger)
+
+		p, err := persister.New(dir, cache, exporter, timeRanges, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return p, timeRanges
+	}
+
+	observe := func(p *persister.Persister, timeRanges *collector.TimeRangeExporter, uuid string, from string) {
+		request := payloadtest.GetPayload(t)
+		request.UUID = uuid
+		request.Type = "heartbeat"
+		request.TimeRange.Raw.From = from
+		request.TimeRange.Raw.To = "now"
+
+		timeRanges.Observe(request)
+		err := p.Append(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p1, timeRanges1 := newTimeRangePersister()
+	observe(p1, timeRanges1, "snapshotted", "now-6h")
+	err = p1.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observe(p1, timeRanges1, "journaled", "now-1h")
+	err = p1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored sessions are not counted again for the range they already had.
+	p2, timeRanges2 := newTimeRangePersister()
+	observe(p2, timeRanges2, "snapshotted", "now-6h")
+	observe(p2, timeRanges2, "journaled", "now-1h")
+	count := testutil.CollectAndCount(timeRanges2, "grafana_analytics_time_ranges_total")
+	if count != 0 {
+		t.Errorf("Expected no time ranges to be counted, got '%d'", count)
+	}
+
+	observe(p2, timeRanges2, "snapshotted", "now-1h")
+	count = testutil.CollectAndCount(timeRanges2, "grafana_analytics_time_ranges_total")
+	if count != 1 {
+		t.Errorf("Expected a single time range to be counted, got '%d'", count)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persister")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p1, cache1, _ := newPersister(t, dir, 0)
+	apply(t, p1, cache1, "snapshotted", "end", 1600000000)
+	err = p1.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, "payloads.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache2 := cacher.NewCache(0, 0)
+	exporter2 := collector.NewExporter(cache2, nil, time.Duration(0), true, nil, logger)
+	err = persister.Load(dir, cache2, exporter2, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := cache2.Get("snapshotted"); !exists {
+		t.Errorf("Expected cache to contain the loaded session")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "payloads.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal not to be created, got %v", err)
+	}
+
+	// A missing storage path is not created.
+	missing := filepath.Join(dir, "missing")
+	err = persister.Load(missing, cacher.NewCache(0, 0), exporter2, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected the storage path not to be created, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/inventory"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DefaultDays is the number of days after which dashboards are unused, if
+// not specified otherwise.
+const DefaultDays = 90
+
+// Dashboard is an unused dashboard. LastViewed is nil if the dashboard was
+// never viewed.
+type Dashboard struct {
+	UID        string     `json:"uid"`
+	Title      string     `json:"title"`
+	Folder     string     `json:"folder"`
+	LastViewer string     `json:"lastViewer,omitempty"`
+	LastViewed *time.Time `json:"lastViewed,omitempty"`
+}
+
+// Report lists the dashboards which were not viewed since a point in time.
+type Report struct {
+	Since      time.Time   `json:"since"`
+	Dashboards []Dashboard `json:"dashboards"`
+}
+
+// Unused returns a Report of the dashboards in the inventory which were not
+// viewed since the given time, with dashboards that were never viewed first.
+// If userData is false, the last viewer is left out.
+func Unused(dashboards []worker.DashboardsResponse, views map[string]collector.View, since time.Time, userData bool) Report {
+	r := Report{Since: since, Dashboards: []Dashboard{}}
+
+	for _, d := range dashboards {
+		dashboard := Dashboard{
+			UID:    d.Uid,
+			Title:  d.Title,
+			Folder: d.FolderTitle,
+		}
+		if dashboard.Folder == "" {
+			dashboard.Folder = inventory.GeneralFolder
+		}
+
+		if v, ok := views[d.Uid]; ok {
+			if !v.Time.Before(since) {
+				continue
+			}
+			lastViewed := v.Time
+			if userData {
+				dashboard.LastViewer = v.Login
+			}
+			dashboard.LastViewed = &lastViewed
+		}
+
+		r.Dashboards = append(r.Dashboards, dashboard)
+	}
+
+	sort.SliceStable(r.Dashboards, func(i, j int) bool {
+		a, b := r.Dashboards[i].LastViewed, r.Dashboards[j].LastViewed
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+
+	return r
+}
+
+// WriteText writes the Report as a table.
+func (r Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "UID\tTITLE\tFOLDER\tLAST VIEWER\tLAST VIEWED")
+	for _, d := range r.Dashboards {
+		lastViewer, lastViewed := "-", "never"
+		if d.LastViewer != "" {
+			lastViewer = d.LastViewer
+		}
+		if d.LastViewed != nil {
+			lastViewed = d.LastViewed.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.UID, d.Title, d.Folder, lastViewer, lastViewed)
+	}
+
+	return tw.Flush()
+}
+
+// WriteJSON writes the Report as JSON.
+func (r Report) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// Handler serves the unused dashboard report, joining the dashboards in
+// Grafana with the views known to the exporter.
+type Handler struct {
+	api      worker.Client
+	exporter *collector.Exporter
+	userData bool
+	logger   log.Logger
+}
+
+// NewHandler creates a new Handler. If userData is false, the report is
+// served without the last viewer of each dashboard.
+func NewHandler(api worker.Client, exporter *collector.Exporter, userData bool, logger log.Logger) *Handler {
+	return &Handler{
+		api:      api,
+		exporter: exporter,
+		userData: userData,
+		logger:   logger,
+	}
+}
+
+// ServeHTTP writes the report as JSON, or as a table if format=text. The
+// number of days may be set with days.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	days := DefaultDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 0 {
+			http.Error(w, "Invalid value for days: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	dashboards, hasErrored := h.api.GetDashboards()
+	if hasErrored {
+		http.Error(w, "Failed to get dashboards from Grafana", http.StatusBadGateway)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	report := Unused(dashboards, h.exporter.LastViews(), since, h.userData)
+
+	var err error
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = report.WriteText(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = report.WriteJSON(w)
+	}
+	if err != nil {
+		level.Error(h.logger).Log("msg", "Failed to write report", "err", err)
+	}
+}
@@ -0,0 +1,100 @@
+package report_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/cacher"
+	"github.com/MacroPower/macropower-analytics-panel/server/collector"
+	"github.com/MacroPower/macropower-analytics-panel/server/payload"
+	"github.com/MacroPower/macropower-analytics-panel/server/payloadtest"
+	"github.com/MacroPower/macropower-analytics-panel/server/report"
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+func TestUnused(t *testing.T) {
+	since := time.Unix(10000, 0)
+	dashboards := []worker.DashboardsResponse{
+		{Uid: "recent", Title: "Recent", Type: "dash-db"},
+		{Uid: "stale", Title: "Stale", Type: "dash-db", FolderTitle: "Team"},
+		{Uid: "never", Title: "Never", Type: "dash-db"},
+	}
+	views := map[string]collector.View{
+		"recent": {Name: "Recent", Login: "alice", Time: time.Unix(20000, 0)},
+		"stale":  {Name: "Stale", Login: "bob", Time: time.Unix(5000, 0)},
+	}
+
+	r := report.Unused(dashboards, views, since, true)
+
+	if len(r.Dashboards) != 2 {
+		t.Fatalf("Expected 2 unused dashboards, got %+v", r.Dashboards)
+	}
+	if r.Dashboards[0].UID != "never" || r.Dashboards[0].LastViewed != nil || r.Dashboards[0].Folder != "General" {
+		t.Errorf("Expected the never viewed dashboard first, got %+v", r.Dashboards[0])
+	}
+	if r.Dashboards[1].UID != "stale" || r.Dashboards[1].LastViewer != "bob" || r.Dashboards[1].Folder != "Team" {
+		t.Errorf("Expected the stale dashboard viewed by bob, got %+v", r.Dashboards[1])
+	}
+
+	text := &strings.Builder{}
+	err := r.WriteText(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "never") {
+		t.Errorf("Expected the never viewed dashboard in the table, got:\n%s", text)
+	}
+
+	r = report.Unused(dashboards, views, since, false)
+	if r.Dashboards[1].LastViewer != "" || r.Dashboards[1].LastViewed == nil {
+		t.Errorf("Expected the stale dashboard without its viewer, got %+v", r.Dashboards[1])
+	}
+}
+
+func TestHandler(t *testing.T) {
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]worker.DashboardsResponse{
+			{Uid: "viewed", Title: "Viewed", Type: "dash-db"},
+			{Uid: "unused", Title: "Unused", Type: "dash-db"},
+		})
+	}))
+	defer grafana.Close()
+
+	cache := cacher.NewCache(0, 0)
+	exporter := collector.NewExporter(cache, nil, time.Duration(0), true, nil, logger)
+
+	request := payloadtest.GetPayload(t)
+	request.Type = "start"
+	request.Dashboard.UID = "viewed"
+	request.Time = int(time.Now().Unix())
+	payload.ProcessPayload(cache, request, logger)
+
+	api := worker.Client{GrafanaUrl: grafana.URL, Logger: logger}
+	testserver := httptest.NewServer(report.NewHandler(api, exporter, true, logger))
+	defer testserver.Close()
+
+	resp, err := http.Get(testserver.URL + "?days=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	r := report.Report{}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Dashboards) != 1 || r.Dashboards[0].UID != "unused" {
+		t.Errorf("Expected only the unused dashboard, got %+v", r.Dashboards)
+	}
+}
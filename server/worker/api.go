@@ -9,6 +9,7 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -18,34 +19,101 @@ type Client struct {
 	Token        string
 	Logger       log.Logger
 	Filter       string
+
+	// Selector selects the dashboards which are patched, and which are part
+	// of the inventory. If nil, all dashboards are selected.
+	Selector *Selector
+
+	// Template is the analytics panel added to dashboards. If nil, the
+	// DefaultPanelTemplate is used.
+	Template *PanelTemplate
+
+	// Reconcile lists the options of existing analytics panels which are
+	// updated to their value in the Template. If empty, existing panels are
+	// left alone. See CheckReconcile.
+	Reconcile []string
 }
 
 const contentTypeJson = "application/json"
 
-func (api *Client) GetDashboards() ([]DashboardsResponse, bool) {
-	res, err := api.Get("/api/search")
-	if err != nil {
-		level.Info(api.Logger).Log(
-			"status", "error",
-			"message", "GetDashboards - Failed to get dashboards data",
-			"error", err,
-		)
+// RequestError is returned for responses with a status other than 200 OK.
+type RequestError struct {
+	Endpoint   string
+	StatusCode int
+	Body       []byte
+}
 
-		return nil, true
-	}
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request failed\nEndpoint: %s\nStatus: %s", e.Endpoint, strconv.Itoa(e.StatusCode))
+}
 
-	var response []DashboardsResponse
-	err = json.Unmarshal(res, &response)
-	if err != nil {
-		level.Info(api.Logger).Log(
-			"status", "error",
-			"message", "GetDashboards - Failed to parse JSON response",
-			"error", err,
-		)
+// searchPageSize is the number of dashboards requested per page. Grafana
+// allows at most 5000.
+const searchPageSize = 1000
+
+// maxSearchPages is the number of pages after which GetDashboards gives up,
+// in case Grafana never returns a short page.
+const maxSearchPages = 1000
 
-		return nil, true
+// GetDashboards returns all dashboards (without folders), requesting pages of
+// search results until there are no more. As versions of Grafana which ignore
+// the page parameter return the first page again, paging also stops once a
+// page holds no new dashboards.
+func (api *Client) GetDashboards() ([]DashboardsResponse, bool) {
+	dashboards := []DashboardsResponse{}
+	seen := map[string]bool{}
+	for page := 1; page <= maxSearchPages; page++ {
+		query := url.Values{}
+		query.Set("type", "dash-db")
+		query.Set("limit", strconv.Itoa(searchPageSize))
+		query.Set("page", strconv.Itoa(page))
+
+		res, err := api.Get("/api/search?" + query.Encode())
+		if err != nil {
+			level.Info(api.Logger).Log(
+				"status", "error",
+				"message", "GetDashboards - Failed to get dashboards data",
+				"page", page,
+				"error", err,
+			)
+
+			return nil, true
+		}
+
+		var response []DashboardsResponse
+		err = json.Unmarshal(res, &response)
+		if err != nil {
+			level.Info(api.Logger).Log(
+				"status", "error",
+				"message", "GetDashboards - Failed to parse JSON response",
+				"page", page,
+				"error", err,
+			)
+
+			return nil, true
+		}
+
+		added := 0
+		for _, d := range response {
+			if seen[d.Uid] {
+				continue
+			}
+			seen[d.Uid] = true
+			dashboards = append(dashboards, d)
+			added++
+		}
+		if len(response) < searchPageSize || added == 0 {
+			return dashboards, false
+		}
 	}
-	return response, false
+
+	level.Info(api.Logger).Log(
+		"status", "error",
+		"message", "GetDashboards - Gave up paging through search results",
+		"pages", maxSearchPages,
+	)
+
+	return nil, true
 }
 
 func (api *Client) GetDashboard(uid string) *Dashboard {
@@ -86,22 +154,20 @@ func (api *Client) Get(endpoint string) ([]byte, error) {
 
 	client := &http.Client{}
 	res, err := client.Do(req)
-	if res.StatusCode != http.StatusOK {
-		errorMessage := fmt.Sprintf("Request failed\nEndpoint: %s\nStatus: %s", endpoint, strconv.Itoa(res.StatusCode))
-
-		return nil, errors.New(errorMessage)
-	}
-
-	defer res.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, &RequestError{Endpoint: endpoint, StatusCode: res.StatusCode, Body: body}
+	}
+
 	return body, nil
 }
 
@@ -116,22 +182,20 @@ func (api *Client) Post(endpoint string, payload []byte) ([]byte, error) {
 
 	client := &http.Client{}
 	res, err := client.Do(req)
-	if res.StatusCode != http.StatusOK {
-		errorMessage := fmt.Sprintf("Request failed\nEndpoint: %s\nStatus: %s", endpoint, strconv.Itoa(res.StatusCode))
-
-		return nil, errors.New(errorMessage)
-	}
-	defer res.Body.Close()
-
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, &RequestError{Endpoint: endpoint, StatusCode: res.StatusCode, Body: body}
+	}
+
 	return body, nil
 }
 
@@ -0,0 +1,84 @@
+package worker_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+)
+
+func TestGetDashboards(t *testing.T) {
+	search := []worker.DashboardsResponse{}
+	for i := 0; i < 2500; i++ {
+		search = append(search, worker.DashboardsResponse{Uid: strconv.Itoa(i), Type: "dash-db", FolderTitle: "Team", Tags: []string{"prod"}})
+	}
+
+	requests := 0
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		query := r.URL.Query()
+		if query.Get("type") != "dash-db" {
+			t.Errorf("Expected only dashboards to be requested, got type %q", query.Get("type"))
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+
+		start, end := (page-1)*limit, page*limit
+		if start > len(search) {
+			start = len(search)
+		}
+		if end > len(search) {
+			end = len(search)
+		}
+		_ = json.NewEncoder(w).Encode(search[start:end])
+	}))
+	defer grafana.Close()
+
+	api := worker.Client{GrafanaUrl: grafana.URL, Logger: logger}
+	dashboards, hasErrored := api.GetDashboards()
+	if hasErrored {
+		t.Fatal("Expected no error")
+	}
+
+	if len(dashboards) != len(search) || dashboards[2499].Uid != "2499" {
+		t.Errorf("Expected all %d dashboards, got %d", len(search), len(dashboards))
+	}
+	if dashboards[0].FolderTitle != "Team" || len(dashboards[0].Tags) != 1 {
+		t.Errorf("Expected the folder and tags, got %+v", dashboards[0])
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 pages to be requested, got %d", requests)
+	}
+}
+
+func TestGetDashboardsIgnoredPage(t *testing.T) {
+	search := []worker.DashboardsResponse{}
+	for i := 0; i < 1000; i++ {
+		search = append(search, worker.DashboardsResponse{Uid: strconv.Itoa(i), Type: "dash-db"})
+	}
+
+	// Grafana returns the first page, whichever page is requested.
+	requests := 0
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(search)
+	}))
+	defer grafana.Close()
+
+	api := worker.Client{GrafanaUrl: grafana.URL, Logger: logger}
+	dashboards, hasErrored := api.GetDashboards()
+	if hasErrored {
+		t.Fatal("Expected no error")
+	}
+
+	if len(dashboards) != len(search) {
+		t.Errorf("Expected %d dashboards, got %d", len(search), len(dashboards))
+	}
+	if requests != 2 {
+		t.Errorf("Expected to stop after the repeated page, got %d requests", requests)
+	}
+}
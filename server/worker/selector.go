@@ -0,0 +1,143 @@
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Fields of a dashboard which can be matched by a Selector.
+const (
+	FieldUid       = "uid"
+	FieldTitle     = "title"
+	FieldFolder    = "folder"
+	FieldFolderUid = "folder_uid"
+	FieldTag       = "tag"
+)
+
+// GeneralFolder is the title of the folder dashboards are in by default.
+const GeneralFolder = "General"
+
+// matcher matches a field of a dashboard, either exactly (field=value) or by
+// a fully anchored regular expression (field=~regex).
+type matcher struct {
+	field string
+	value string
+	re    *regexp.Regexp
+}
+
+func parseMatcher(s string) (matcher, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return matcher{}, fmt.Errorf("Invalid matcher %q, expected field=value or field=~regex", s)
+	}
+
+	m := matcher{
+		field: strings.TrimSpace(s[:i]),
+		value: s[i+1:],
+	}
+	switch m.field {
+	case FieldUid, FieldTitle, FieldFolder, FieldFolderUid, FieldTag:
+	default:
+		return matcher{}, fmt.Errorf("Invalid matcher %q, unknown field %q", s, m.field)
+	}
+
+	if strings.HasPrefix(m.value, "~") {
+		re, err := regexp.Compile("^(?:" + m.value[1:] + ")$")
+		if err != nil {
+			return matcher{}, fmt.Errorf("Invalid matcher %q: %w", s, err)
+		}
+		m.re = re
+	}
+
+	return m, nil
+}
+
+func (m matcher) matchValue(v string) bool {
+	if m.re != nil {
+		return m.re.MatchString(v)
+	}
+	return v == m.value
+}
+
+func (m matcher) matches(d DashboardsResponse) bool {
+	switch m.field {
+	case FieldUid:
+		return m.matchValue(d.Uid)
+	case FieldTitle:
+		return m.matchValue(d.Title)
+	case FieldFolder:
+		folder := d.FolderTitle
+		if folder == "" {
+			folder = GeneralFolder
+		}
+		return m.matchValue(folder)
+	case FieldFolderUid:
+		return m.matchValue(d.FolderUid)
+	case FieldTag:
+		for _, tag := range d.Tags {
+			if m.matchValue(tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Selector selects dashboards by include and exclude matchers. A dashboard is
+// selected if it matches any include matcher (or there are none), and no
+// exclude matcher. A nil Selector selects all dashboards.
+type Selector struct {
+	include []matcher
+	exclude []matcher
+}
+
+// ParseSelector parses the include and exclude matchers of a Selector. Each
+// matcher has the form field=value or field=~regex, where field is one of
+// uid, title, folder, folder_uid or tag.
+func ParseSelector(include, exclude []string) (*Selector, error) {
+	s := &Selector{}
+
+	for _, v := range include {
+		m, err := parseMatcher(v)
+		if err != nil {
+			return nil, err
+		}
+		s.include = append(s.include, m)
+	}
+
+	for _, v := range exclude {
+		m, err := parseMatcher(v)
+		if err != nil {
+			return nil, err
+		}
+		s.exclude = append(s.exclude, m)
+	}
+
+	return s, nil
+}
+
+// Matches reports whether the dashboard is selected.
+func (s *Selector) Matches(d DashboardsResponse) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, m := range s.exclude {
+		if m.matches(d) {
+			return false
+		}
+	}
+
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, m := range s.include {
+		if m.matches(d) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,56 @@
+package worker_test
+
+import (
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+)
+
+func TestSelector(t *testing.T) {
+	dashboards := []worker.DashboardsResponse{
+		{Uid: "a", Title: "Team A Overview", FolderUid: "team-a", FolderTitle: "Team A", Tags: []string{"production"}},
+		{Uid: "b", Title: "Team A Secrets", FolderUid: "team-a", FolderTitle: "Team A", Tags: []string{"sensitive"}},
+		{Uid: "c", Title: "Team B Overview", FolderUid: "team-b", FolderTitle: "Team B"},
+		{Uid: "d", Title: "Home"},
+	}
+
+	tests := []struct {
+		include  []string
+		exclude  []string
+		expected string
+	}{
+		{nil, nil, "abcd"},
+		{[]string{"folder=Team A"}, nil, "ab"},
+		{[]string{"folder_uid=team-b", "folder=General"}, nil, "cd"},
+		{[]string{"title=~.*Overview"}, nil, "ac"},
+		{[]string{"uid=a", "uid=d"}, nil, "ad"},
+		{[]string{"tag=~prod.*"}, nil, "a"},
+		{nil, []string{"tag=sensitive"}, "acd"},
+		{[]string{"folder=Team A"}, []string{"tag=sensitive"}, "a"},
+	}
+
+	for _, test := range tests {
+		selector, err := worker.ParseSelector(test.include, test.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		selected := ""
+		for _, d := range dashboards {
+			if selector.Matches(d) {
+				selected += d.Uid
+			}
+		}
+		if selected != test.expected {
+			t.Errorf("Expected %v without %v to select %s, got %s", test.include, test.exclude, test.expected, selected)
+		}
+	}
+}
+
+func TestSelectorInvalid(t *testing.T) {
+	for _, matcher := range []string{"title", "owner=me", "title=~("} {
+		if _, err := worker.ParseSelector([]string{matcher}, nil); err == nil {
+			t.Errorf("Expected an error for %s", matcher)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+)
+
+// Placeholders which are replaced when a PanelTemplate is rendered.
+// PlaceholderAnalyticsUrl may be part of a string, while PlaceholderPanelId
+// must be the whole value, and is replaced with a number.
+const (
+	PlaceholderAnalyticsUrl = "$__analytics_url"
+	PlaceholderPanelId      = "$__panel_id"
+)
+
+// DefaultPanelTemplate is the panel added to dashboards if no template is
+// configured.
+const DefaultPanelTemplate = `{
+  "id": "$__panel_id",
+  "title": "Analytics",
+  "type": "macropower-analytics-panel",
+  "gridPos": {"h": 0, "w": 0, "x": 0, "y": 0},
+  "options": {
+    "analyticsOptions": {
+      "dashboard": "$__dashboard",
+      "flatten": false,
+      "heartbeatAlways": false,
+      "heartbeatInterval": 60,
+      "postEnd": false,
+      "postHeartbeat": false,
+      "postStart": true,
+      "server": "$__analytics_url/write"
+    }
+  }
+}`
+
+// PanelTemplate is the JSON model of the analytics panel added to dashboards,
+// which may contain placeholders.
+type PanelTemplate struct {
+	panel map[string]interface{}
+}
+
+// ParsePanelTemplate parses and validates a panel template. As YAML is a
+// superset of JSON, the template may be either.
+func ParsePanelTemplate(data []byte) (*PanelTemplate, error) {
+	var raw interface{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	panel, ok := fromYaml(raw).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Panel template must be an object")
+	}
+
+	if !isAnalyticsPanel(panel) {
+		return nil, fmt.Errorf("Panel template must have type %q", analyticsPanelType)
+	}
+
+	options, _ := panel["options"].(map[string]interface{})
+	analyticsOptions, ok := options["analyticsOptions"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Panel template must have options.analyticsOptions")
+	}
+	if server, _ := analyticsOptions["server"].(string); server == "" {
+		return nil, errors.New("Panel template must have options.analyticsOptions.server")
+	}
+
+	if id, ok := panel["id"]; ok && id != PlaceholderPanelId {
+		return nil, fmt.Errorf("Panel template id must be %q, as ids are assigned per dashboard", PlaceholderPanelId)
+	}
+
+	return &PanelTemplate{panel: panel}, nil
+}
+
+// LoadPanelTemplate reads and validates a panel template from a file.
+func LoadPanelTemplate(path string) (*PanelTemplate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := ParsePanelTemplate(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid panel template %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// Render returns a copy of the template with the placeholders replaced.
+func (t *PanelTemplate) Render(panelId int, analyticsUrl string) map[string]interface{} {
+	panel := render(t.panel, panelId, analyticsUrl).(map[string]interface{})
+	panel["id"] = panelId
+
+	return panel
+}
+
+// AnalyticsOptions returns the rendered options of the analytics panel.
+func (t *PanelTemplate) AnalyticsOptions(analyticsUrl string) map[string]interface{} {
+	options := t.panel["options"].(map[string]interface{})["analyticsOptions"]
+
+	return render(options, 0, analyticsUrl).(map[string]interface{})
+}
+
+func render(value interface{}, panelId int, analyticsUrl string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			rendered[key] = render(value, panelId, analyticsUrl)
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, value := range v {
+			rendered[i] = render(value, panelId, analyticsUrl)
+		}
+		return rendered
+	case string:
+		if v == PlaceholderPanelId {
+			return panelId
+		}
+		return strings.ReplaceAll(v, PlaceholderAnalyticsUrl, analyticsUrl)
+	default:
+		return v
+	}
+}
+
+// fromYaml converts the maps decoded by yaml to maps with string keys, so
+// the template can be encoded as JSON.
+func fromYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[fmt.Sprint(key)] = fromYaml(value)
+		}
+		return converted
+	case []interface{}:
+		for i, value := range v {
+			v[i] = fromYaml(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+var defaultPanelTemplate = mustParsePanelTemplate(DefaultPanelTemplate)
+
+func mustParsePanelTemplate(data string) *PanelTemplate {
+	t, err := ParsePanelTemplate([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
@@ -0,0 +1,52 @@
+package worker_test
+
+import (
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+)
+
+func TestParsePanelTemplate(t *testing.T) {
+	template, err := worker.ParsePanelTemplate([]byte(`
+id: $__panel_id
+title: Usage
+type: macropower-analytics-panel
+transparent: true
+gridPos: {h: 2, w: 24, x: 0, y: 0}
+options:
+  analyticsOptions:
+    server: $__analytics_url/write
+    postEnd: true
+    heartbeatInterval: 30
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	panel := template.Render(7, "http://analytics")
+	if panel["id"] != 7 || panel["title"] != "Usage" || panel["transparent"] != true {
+		t.Errorf("Expected the rendered panel, got %v", panel)
+	}
+
+	options := template.AnalyticsOptions("http://analytics")
+	if options["server"] != "http://analytics/write" || options["heartbeatInterval"] != 30 {
+		t.Errorf("Expected the rendered options, got %v", options)
+	}
+}
+
+func TestParsePanelTemplateInvalid(t *testing.T) {
+	templates := map[string]string{
+		"not an object":  `[]`,
+		"wrong type":     `{"type": "graph", "options": {"analyticsOptions": {"server": "$__analytics_url/write"}}}`,
+		"no options":     `{"type": "macropower-analytics-panel"}`,
+		"no server":      `{"type": "macropower-analytics-panel", "options": {"analyticsOptions": {}}}`,
+		"fixed id":       `{"id": 1, "type": "macropower-analytics-panel", "options": {"analyticsOptions": {"server": "$__analytics_url/write"}}}`,
+		"invalid syntax": `{"type": `,
+	}
+
+	for name, template := range templates {
+		if _, err := worker.ParsePanelTemplate([]byte(template)); err == nil {
+			t.Errorf("Expected an error for a template with %s", name)
+		}
+	}
+}
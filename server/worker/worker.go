@@ -2,8 +2,14 @@ package worker
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -14,8 +20,12 @@ type Dashboard struct {
 }
 
 type DashboardsResponse struct {
-	Uid   string `json:"uid"`
-	Title string `json:"title"`
+	Uid         string   `json:"uid"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	FolderUid   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
 }
 
 type DashboardResponse struct {
@@ -32,67 +42,440 @@ type DashboardUpdateResponse struct {
 	Version   uint64 `json:"version"`
 }
 
-func (api *Client) AddAnalyticsToDashboards() {
+// Statuses of a PatchResult.
+const (
+	StatusUpdated     = "updated"
+	StatusUnchanged   = "unchanged"
+	StatusWouldUpdate = "would-update"
+	StatusFailed      = "failed"
+	StatusConflict    = "conflict"
+)
+
+// updateAttempts is the number of times a dashboard is fetched and patched,
+// if it is changed concurrently.
+const updateAttempts = 3
+
+// errVersionMismatch is returned if a dashboard was changed since it was
+// fetched.
+var errVersionMismatch = errors.New("Dashboard version mismatch")
+
+// PatchOperation is a JSON Patch (RFC 6902) operation on the JSON model of a
+// dashboard, as returned by /api/dashboards/uid/:uid.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PatchResult is the result of patching a single dashboard.
+type PatchResult struct {
+	Uid    string           `json:"uid"`
+	Title  string           `json:"title"`
+	Status string           `json:"status"`
+	Diff   []PatchOperation `json:"diff,omitempty"`
+	Drift  []OptionDrift    `json:"drift,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// OptionDrift is an option of an existing analytics panel which differs from
+// the desired configuration. Current is nil if the option is not set.
+type OptionDrift struct {
+	PanelId int         `json:"panelId"`
+	Option  string      `json:"option"`
+	Current interface{} `json:"current"`
+	Desired interface{} `json:"desired"`
+}
+
+// AddAnalyticsToDashboards adds an analytics panel to each dashboard which
+// does not have one yet, and updates the Reconcile options of existing
+// analytics panels which differ from the template. With dryRun, no dashboards
+// are saved, and the results hold the changes which would have been made.
+func (api *Client) AddAnalyticsToDashboards(dryRun bool) ([]PatchResult, error) {
+	return api.patchDashboards(dryRun, api.addAnalyticsPanel)
+}
+
+// RemoveAnalyticsFromDashboards removes all analytics panels from each
+// dashboard, including panels in collapsed rows. With dryRun, no dashboards
+// are saved, and the results hold the changes which would have been made.
+func (api *Client) RemoveAnalyticsFromDashboards(dryRun bool) ([]PatchResult, error) {
+	return api.patchDashboards(dryRun, removeAnalyticsPanels)
+}
+
+// patch describes the changes made to a dashboard, and the commit message
+// they are saved with.
+type patch struct {
+	message string
+	diff    []PatchOperation
+	drift   []OptionDrift
+}
+
+// patchFunc changes the JSON model of a dashboard, and returns the changes
+// it made. Nothing is saved if there is no diff.
+type patchFunc func(dashboardData map[string]interface{}) patch
+
+func (api *Client) patchDashboards(dryRun bool, patch patchFunc) ([]PatchResult, error) {
 	response, hasErrored := api.GetDashboards()
 	if hasErrored {
-		return
+		return nil, errors.New("Failed to get dashboards")
 	}
 
-	var dashboardsToUpdate []Dashboard
+	hasFilter := utf8.RuneCountInString(api.Filter) > 0
+
+	results := []PatchResult{}
 	for _, dashboardEntry := range response {
-		hasAnalyticsPanel := false
+		if !api.Selector.Matches(dashboardEntry) {
+			continue
+		}
+
+		// Update only dashboard what was requested in filter
+		if hasFilter && dashboardEntry.Title != api.Filter {
+			continue
+		}
+
+		results = append(results, api.patchDashboard(dashboardEntry, dryRun, patch))
+	}
+
+	return results, nil
+}
+
+func (api *Client) patchDashboard(dashboardEntry DashboardsResponse, dryRun bool, patch patchFunc) PatchResult {
+	result := PatchResult{
+		Uid:   dashboardEntry.Uid,
+		Title: dashboardEntry.Title,
+	}
+
+	// The dashboard is saved with the version it was fetched with, so saves
+	// made in the meantime are never overwritten. Instead, the dashboard is
+	// fetched and patched again.
+	for attempt := 1; attempt <= updateAttempts; attempt++ {
 		rawDashboardData := api.GetDashboard(dashboardEntry.Uid)
+		if rawDashboardData == nil {
+			result.Status = StatusFailed
+			result.Error = "Failed to get dashboard"
+			return result
+		}
+
 		dashboardData := getTypedDashboardData(rawDashboardData)
-		panels := getTypedPanelsData(dashboardData)
-
-		largestPanelId := 0
-		largestPanelId, hasAnalyticsPanel = checkAnalyticsPanelExistence(panels, largestPanelId, hasAnalyticsPanel, api.Logger)
-
-		title, ok := dashboardData["title"]
-		if !hasAnalyticsPanel && ok {
-			newAnalyticsPanel := createAnalyticsPanelData(largestPanelId+1, api.AnalyticsUrl)
-			panels = append([]interface{}{newAnalyticsPanel}, panels...)
-			dashboardData["panels"] = panels
-			rawDashboardData.Data["dashboard"] = dashboardData
-
-			dashboardsToUpdate = append(dashboardsToUpdate, Dashboard{
-				Uid:   dashboardEntry.Uid,
-				Data:  rawDashboardData.Data,
-				Title: title.(string),
-			})
+		if dashboardData == nil {
+			result.Status = StatusFailed
+			result.Error = "Failed to parse dashboard"
+			return result
 		}
+
+		changes := patch(dashboardData)
+		result.Diff = changes.diff
+		result.Drift = changes.drift
+		if len(result.Diff) == 0 {
+			result.Status = StatusUnchanged
+			return result
+		}
+
+		if dryRun {
+			result.Status = StatusWouldUpdate
+			logDryRun(api.Logger, result)
+			return result
+		}
+
+		rawDashboardData.Data["dashboard"] = dashboardData
+
+		err := api.updateDashboard(Dashboard{
+			Uid:   dashboardEntry.Uid,
+			Data:  rawDashboardData.Data,
+			Title: dashboardEntry.Title,
+		}, changes.message)
+		if errors.Is(err, errVersionMismatch) {
+			level.Info(api.Logger).Log(
+				"status", "conflict",
+				"message", "patchDashboard - Dashboard was changed concurrently: "+dashboardEntry.Title,
+				"uid", dashboardEntry.Uid,
+				"attempt", attempt,
+			)
+
+			continue
+		}
+		if err != nil {
+			result.Status = StatusFailed
+			result.Error = err.Error()
+			return result
+		}
+
+		result.Status = StatusUpdated
+		return result
+	}
+
+	result.Status = StatusConflict
+	result.Error = fmt.Sprintf("Dashboard was changed concurrently, gave up after %d attempts", updateAttempts)
+
+	level.Info(api.Logger).Log(
+		"status", "error",
+		"message", "patchDashboard - Gave up updating "+dashboardEntry.Title,
+		"uid", dashboardEntry.Uid,
+		"error", result.Error,
+	)
+
+	return result
+}
+
+func (api *Client) panelTemplate() *PanelTemplate {
+	if api.Template == nil {
+		return defaultPanelTemplate
 	}
 
-	api.updateDashboards(dashboardsToUpdate)
+	return api.Template
 }
 
-func (api *Client) updateDashboards(dashboards []Dashboard) {
-	hasFilter := false
+// CheckReconcile returns an error if a Reconcile option is not set in the
+// panel template, or if server is reconciled but does not render to an
+// absolute URL, e.g. because AnalyticsUrl is only a listen address.
+func (api *Client) CheckReconcile() error {
+	options := api.panelTemplate().AnalyticsOptions(api.AnalyticsUrl)
+	for _, key := range api.Reconcile {
+		value, ok := options[key]
+		if !ok {
+			return fmt.Errorf("Cannot reconcile option %q, as it is not set in the panel template", key)
+		}
 
-	if utf8.RuneCountInString(api.Filter) > 0 {
-		hasFilter = true
+		if key == "server" {
+			server, _ := value.(string)
+			u, err := url.Parse(server)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("Cannot reconcile option \"server\", as %q is not an absolute URL", server)
+			}
+		}
 	}
 
-	for _, dashboard := range dashboards {
-		// Update only dashboard what was requested in filter
-		if hasFilter && dashboard.Title != api.Filter {
+	return nil
+}
+
+// reconcileOptions returns the desired values of the Reconcile options.
+func (api *Client) reconcileOptions() map[string]interface{} {
+	options := api.panelTemplate().AnalyticsOptions(api.AnalyticsUrl)
+
+	desired := make(map[string]interface{}, len(api.Reconcile))
+	for _, key := range api.Reconcile {
+		if value, ok := options[key]; ok {
+			desired[key] = value
+		}
+	}
+
+	return desired
+}
+
+// addAnalyticsPanel adds an analytics panel as the first panel, unless the
+// dashboard has one already, in which case its Reconcile options are
+// reconciled.
+func (api *Client) addAnalyticsPanel(dashboardData map[string]interface{}) patch {
+	panels := getTypedPanelsData(dashboardData)
+
+	existing := findAnalyticsPanels(panels, "/dashboard/panels")
+	if len(existing) > 0 {
+		desired := api.reconcileOptions()
+		if len(desired) == 0 {
+			return patch{}
+		}
+		return reconcileAnalyticsPanels(existing, desired)
+	}
+
+	newAnalyticsPanel := api.panelTemplate().Render(largestPanelId(panels, api.Logger)+1, api.AnalyticsUrl)
+	dashboardData["panels"] = append([]interface{}{newAnalyticsPanel}, panels...)
+
+	return patch{
+		message: "macropower-analytics-panel - Auto-add analytics panel",
+		diff: []PatchOperation{
+			{Op: "add", Path: "/dashboard/panels/0", Value: newAnalyticsPanel},
+		},
+	}
+}
+
+// removeAnalyticsPanels removes all analytics panels, including the panels
+// of collapsed rows. The operations are ordered so that they can be applied
+// one after another.
+func removeAnalyticsPanels(dashboardData map[string]interface{}) patch {
+	panels, diff := removePanels(getTypedPanelsData(dashboardData), "/dashboard/panels")
+	if len(diff) > 0 {
+		dashboardData["panels"] = panels
+	}
+
+	return patch{
+		message: fmt.Sprintf("macropower-analytics-panel - Remove %d analytics panel(s)", len(diff)),
+		diff:    diff,
+	}
+}
+
+// analyticsPanel is an analytics panel and its JSON Pointer.
+type analyticsPanel struct {
+	path  string
+	panel map[string]interface{}
+}
+
+// findAnalyticsPanels returns the analytics panels, including the panels of
+// collapsed rows.
+func findAnalyticsPanels(panels []interface{}, path string) []analyticsPanel {
+	found := []analyticsPanel{}
+	for i, panel := range panels {
+		panelMap, ok := panel.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		panelPath := fmt.Sprintf("%s/%d", path, i)
+		if isAnalyticsPanel(panelMap) {
+			found = append(found, analyticsPanel{path: panelPath, panel: panelMap})
+			continue
+		}
+
+		if rowPanels, ok := panelMap["panels"].([]interface{}); ok {
+			found = append(found, findAnalyticsPanels(rowPanels, panelPath+"/panels")...)
+		}
+	}
+
+	return found
+}
+
+// reconcileAnalyticsPanels sets the options of the panels which differ from
+// the desired options. Other options are left alone.
+func reconcileAnalyticsPanels(panels []analyticsPanel, desired map[string]interface{}) patch {
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := patch{}
+	drifted := map[string]bool{}
+	for _, p := range panels {
+		panelId, _ := p.panel["id"].(float64)
+		path := p.path + "/options"
+
+		var current map[string]interface{}
+		options, _ := p.panel["options"].(map[string]interface{})
+		if options != nil {
+			current, _ = options["analyticsOptions"].(map[string]interface{})
+		}
+
+		drift := []OptionDrift{}
+		for _, key := range keys {
+			value, ok := current[key]
+			if ok && jsonEqual(value, desired[key]) {
+				continue
+			}
+
+			drift = append(drift, OptionDrift{
+				PanelId: int(panelId),
+				Option:  key,
+				Current: value,
+				Desired: desired[key],
+			})
+			drifted[key] = true
+		}
+		if len(drift) == 0 {
 			continue
 		}
+		result.drift = append(result.drift, drift...)
+
+		// Missing objects are added empty, so that only the drifted options
+		// are set.
+		switch {
+		case options == nil:
+			current = map[string]interface{}{}
+			options = map[string]interface{}{"analyticsOptions": current}
+			p.panel["options"] = options
+			result.diff = append(result.diff, PatchOperation{Op: "add", Path: path, Value: map[string]interface{}{"analyticsOptions": map[string]interface{}{}}})
+		case current == nil:
+			current = map[string]interface{}{}
+			options["analyticsOptions"] = current
+			result.diff = append(result.diff, PatchOperation{Op: "add", Path: path + "/analyticsOptions", Value: map[string]interface{}{}})
+		}
+		for _, d := range drift {
+			op := "replace"
+			if d.Current == nil {
+				op = "add"
+			}
+			current[d.Option] = d.Desired
+			result.diff = append(result.diff, PatchOperation{Op: op, Path: path + "/analyticsOptions/" + d.Option, Value: d.Desired})
+		}
+	}
+
+	options := []string{}
+	for _, key := range keys {
+		if drifted[key] {
+			options = append(options, key)
+		}
+	}
+	result.message = "macropower-analytics-panel - Update analytics panel options: " + strings.Join(options, ", ")
 
-		api.updateDashboard(dashboard)
+	return result
+}
+
+func jsonEqual(a, b interface{}) bool {
+	aJson, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJson, err := json.Marshal(b)
+	if err != nil {
+		return false
 	}
+
+	return string(aJson) == string(bJson)
 }
 
-func (api *Client) updateDashboard(dashboard Dashboard) {
-	dashboard.Data["overwrite"] = true
-	dashboard.Data["message"] = "macropower-analytics-panel - Auto-add analytics panel"
+func removePanels(panels []interface{}, path string) ([]interface{}, []PatchOperation) {
+	kept := []interface{}{}
+	diff := []PatchOperation{}
+	removed := []PatchOperation{}
+
+	for i, panel := range panels {
+		panelMap, ok := panel.(map[string]interface{})
+		if !ok {
+			kept = append(kept, panel)
+			continue
+		}
+
+		if isAnalyticsPanel(panelMap) {
+			// Later panels are removed first, so the indices stay valid.
+			removed = append([]PatchOperation{{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)}}, removed...)
+			continue
+		}
+
+		if rowPanels, ok := panelMap["panels"].([]interface{}); ok {
+			rowPanels, rowDiff := removePanels(rowPanels, fmt.Sprintf("%s/%d/panels", path, i))
+			if len(rowDiff) > 0 {
+				panelMap["panels"] = rowPanels
+				diff = append(diff, rowDiff...)
+			}
+		}
+
+		kept = append(kept, panel)
+	}
+
+	return kept, append(diff, removed...)
+}
+
+func (api *Client) updateDashboard(dashboard Dashboard, message string) error {
+	// Grafana rejects the update if the dashboard's version changed.
+	dashboard.Data["overwrite"] = false
+	dashboard.Data["message"] = message
+
+	// Grafana reads the folder from the request rather than from the meta
+	// returned with the dashboard, and would otherwise move it to General.
+	meta, _ := dashboard.Data["meta"].(map[string]interface{})
+	if folderUid, ok := meta["folderUid"]; ok {
+		dashboard.Data["folderUid"] = folderUid
+	}
+	if folderId, ok := meta["folderId"]; ok {
+		dashboard.Data["folderId"] = folderId
+	}
 
 	payload, err := json.Marshal(dashboard.Data)
 	if err != nil {
-		return
+		return err
 	}
 
 	res, err := api.Post("/api/dashboards/db", payload)
+	if isVersionMismatch(err) {
+		return errVersionMismatch
+	}
 	if err != nil {
 		level.Info(api.Logger).Log(
 			"status", "error",
@@ -100,7 +483,7 @@ func (api *Client) updateDashboard(dashboard Dashboard) {
 			"error", err,
 		)
 
-		return
+		return err
 	}
 
 	var responseAsStruct DashboardUpdateResponse
@@ -112,44 +495,80 @@ func (api *Client) updateDashboard(dashboard Dashboard) {
 			"error", err,
 		)
 
-		return
+		return err
 	}
 
-	if responseAsStruct.Status == "success" {
-		level.Info(api.Logger).Log(
-			"status", "success",
-			"message", "updateDashboards - Added analytics to "+dashboard.Title,
-			"error", err,
-		)
+	if responseAsStruct.Status != "success" {
+		return errors.New("Unexpected update status: " + responseAsStruct.Status)
 	}
+
+	level.Info(api.Logger).Log(
+		"status", "success",
+		"message", "updateDashboards - Updated "+dashboard.Title,
+		"commit_message", message,
+	)
+
+	return nil
 }
 
-func checkAnalyticsPanelExistence(panels []interface{}, largestPanelId int, hasAnalyticsPanel bool, logger log.Logger) (int, bool) {
+// isVersionMismatch reports whether Grafana rejected an update because the
+// dashboard was saved by someone else since it was fetched. Grafana responds
+// with 412 for other reasons as well, e.g. if the title is already taken.
+func isVersionMismatch(err error) bool {
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) || requestErr.StatusCode != http.StatusPreconditionFailed {
+		return false
+	}
+
+	var response DashboardUpdateResponse
+	_ = json.Unmarshal(requestErr.Body, &response)
+
+	return response.Status == "version-mismatch"
+}
+
+func logDryRun(logger log.Logger, result PatchResult) {
+	diff, err := json.Marshal(result.Diff)
+	if err != nil {
+		return
+	}
+
+	level.Info(logger).Log(
+		"status", "dry-run",
+		"message", "patchDashboard - Would update "+result.Title,
+		"uid", result.Uid,
+		"diff", string(diff),
+	)
+}
+
+// largestPanelId returns the largest panel id, including the panels of
+// collapsed rows.
+func largestPanelId(panels []interface{}, logger log.Logger) int {
+	largest := 0
 	for _, panel := range panels {
 		panelMap, ok := panel.(map[string]interface{})
 		if !ok {
 			level.Info(logger).Log(
 				"status", "error",
-				"message", "checkAnalyticsPanelExistence - Failed to type cast panel data",
+				"message", "largestPanelId - Failed to type cast panel data",
 			)
 
 			continue
 		}
 
 		// Go reports id as float, instead of int
-		panelId := panelMap["id"].(float64)
-		panelIdAsInt := int(panelId)
-		if largestPanelId < panelIdAsInt {
-			largestPanelId = panelIdAsInt
+		panelId, _ := panelMap["id"].(float64)
+		if largest < int(panelId) {
+			largest = int(panelId)
 		}
 
-		if isAnalyticsPanel(panelMap) {
-			hasAnalyticsPanel = true
-
-			break
+		if rowPanels, ok := panelMap["panels"].([]interface{}); ok {
+			if rowLargest := largestPanelId(rowPanels, logger); largest < rowLargest {
+				largest = rowLargest
+			}
 		}
 	}
-	return largestPanelId, hasAnalyticsPanel
+
+	return largest
 }
 
 func getTypedDashboardData(rawDashboardData *Dashboard) map[string]interface{} {
@@ -186,34 +605,10 @@ func getTypedPanelsData(dashboardData map[string]interface{}) []interface{} {
 	return panelList
 }
 
+const analyticsPanelType = "macropower-analytics-panel"
+
 func isAnalyticsPanel(panel map[string]interface{}) bool {
 	panelType, ok := panel["type"]
 
-	return ok && panelType == "macropower-analytics-panel"
-}
-
-func createAnalyticsPanelData(panelId int, analyticsUrl string) map[string]interface{} {
-	return map[string]interface{}{
-		"id":    panelId,
-		"title": "Analytics",
-		"type":  "macropower-analytics-panel",
-		"gridPos": map[string]interface{}{
-			"h": 0,
-			"w": 0,
-			"x": 0,
-			"y": 0,
-		},
-		"options": map[string]interface{}{
-			"analyticsOptions": map[string]interface{}{
-				"dashboard":         "$__dashboard",
-				"flatten":           false,
-				"heartbeatAlways":   false,
-				"heartbeatInterval": 60,
-				"postEnd":           false,
-				"postHeartbeat":     false,
-				"postStart":         true,
-				"server":            analyticsUrl + "/write",
-			},
-		},
-	}
+	return ok && panelType == analyticsPanelType
 }
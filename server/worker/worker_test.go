@@ -0,0 +1,410 @@
+package worker_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MacroPower/macropower-analytics-panel/server/worker"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	logger = log.NewNopLogger()
+)
+
+// grafana is a fake Grafana API serving a set of dashboards.
+type grafana struct {
+	mu         sync.Mutex
+	dashboards map[string]map[string]interface{}
+	posted     []map[string]interface{}
+
+	// folders holds the folder UID of the dashboards which are in a folder.
+	folders map[string]string
+
+	// conflicts is the number of saves to reject as if the dashboard was
+	// changed concurrently.
+	conflicts int
+}
+
+func newGrafana(t *testing.T, dashboards map[string]string) (*httptest.Server, *grafana) {
+	g := &grafana{dashboards: map[string]map[string]interface{}{}, folders: map[string]string{}}
+	for uid, model := range dashboards {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(model), &data); err != nil {
+			t.Fatal(err)
+		}
+		g.dashboards[uid] = data
+	}
+
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+
+	return server, g
+}
+
+func (g *grafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/search":
+		search := []worker.DashboardsResponse{}
+		for uid, data := range g.dashboards {
+			search = append(search, worker.DashboardsResponse{Uid: uid, Title: data["title"].(string), Type: "dash-db"})
+		}
+		_ = json.NewEncoder(w).Encode(search)
+	case strings.HasPrefix(r.URL.Path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(r.URL.Path, "/api/dashboards/uid/")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"dashboard": g.dashboards[uid],
+			"meta":      map[string]interface{}{"folderUid": g.folders[uid]},
+		})
+	case r.URL.Path == "/api/dashboards/db" && r.Method == http.MethodPost:
+		body, _ := ioutil.ReadAll(r.Body)
+		posted := map[string]interface{}{}
+		_ = json.Unmarshal(body, &posted)
+		g.posted = append(g.posted, posted)
+
+		dashboard := posted["dashboard"].(map[string]interface{})
+		current := g.dashboards[dashboard["uid"].(string)]
+		if g.conflicts > 0 {
+			g.conflicts--
+			current["version"] = current["version"].(float64) + 1
+		}
+		if posted["overwrite"] != true && dashboard["version"] != current["version"] {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_ = json.NewEncoder(w).Encode(worker.DashboardUpdateResponse{Status: "version-mismatch"})
+			return
+		}
+
+		dashboard["version"] = current["version"].(float64) + 1
+		g.dashboards[dashboard["uid"].(string)] = dashboard
+		_ = json.NewEncoder(w).Encode(worker.DashboardUpdateResponse{Status: "success", Uid: dashboard["uid"].(string)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var testDashboards = map[string]string{
+	"without": `{"uid": "without", "title": "Without", "version": 1, "panels": [{"id": 1, "type": "graph"}, {"id": 4, "type": "graph"}]}`,
+	"with": `{"uid": "with", "title": "With", "version": 1, "panels": [{"id": 1, "type": "macropower-analytics-panel", "options": {"analyticsOptions": {
+		"dashboard": "$__dashboard", "flatten": false, "heartbeatAlways": false, "heartbeatInterval": 60,
+		"postEnd": false, "postHeartbeat": false, "postStart": true, "server": "http://analytics/write"
+	}}}]}`,
+}
+
+func resultsByUid(results []worker.PatchResult) map[string]worker.PatchResult {
+	byUid := map[string]worker.PatchResult{}
+	for _, r := range results {
+		byUid[r.Uid] = r
+	}
+	return byUid
+}
+
+func TestAddAnalyticsDryRun(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	results, err := api.AddAnalyticsToDashboards(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byUid := resultsByUid(results)
+	if byUid["with"].Status != worker.StatusUnchanged {
+		t.Errorf("Expected the dashboard with a panel to be unchanged, got %+v", byUid["with"])
+	}
+
+	without := byUid["without"]
+	if without.Status != worker.StatusWouldUpdate || len(without.Diff) != 1 {
+		t.Fatalf("Expected the dashboard without a panel to be updated, got %+v", without)
+	}
+	if without.Diff[0].Op != "add" || without.Diff[0].Path != "/dashboard/panels/0" {
+		t.Errorf("Expected the panel to be added first, got %+v", without.Diff[0])
+	}
+	if panel := without.Diff[0].Value.(map[string]interface{}); panel["id"] != 5 {
+		t.Errorf("Expected the panel to have the next free id, got %v", panel["id"])
+	}
+
+	if posted := g.posted; len(posted) != 0 {
+		t.Errorf("Expected no dashboards to be saved, got %d", len(posted))
+	}
+}
+
+func TestAddAnalyticsRowPanelId(t *testing.T) {
+	server, _ := newGrafana(t, map[string]string{
+		"row": `{"uid": "row", "title": "Row", "version": 1, "panels": [{"id": 1, "type": "graph"}, {"id": 2, "type": "row", "collapsed": true, "panels": [{"id": 9, "type": "graph"}]}]}`,
+	})
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	results, err := api.AddAnalyticsToDashboards(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Diff) != 1 {
+		t.Fatalf("Expected the panel to be added, got %+v", results)
+	}
+	if panel := results[0].Diff[0].Value.(map[string]interface{}); panel["id"] != 10 {
+		t.Errorf("Expected the panel id to be larger than the ids of collapsed row panels, got %v", panel["id"])
+	}
+}
+
+func TestAddAnalytics(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	g.folders["without"] = "team"
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := resultsByUid(results)["without"].Status; status != worker.StatusUpdated {
+		t.Errorf("Expected the dashboard without a panel to be updated, got %s", status)
+	}
+
+	posted := g.posted
+	if len(posted) != 1 {
+		t.Fatalf("Expected one dashboard to be saved, got %d", len(posted))
+	}
+	panels := posted[0]["dashboard"].(map[string]interface{})["panels"].([]interface{})
+	if len(panels) != 3 || panels[0].(map[string]interface{})["type"] != "macropower-analytics-panel" {
+		t.Errorf("Expected the analytics panel to be added first, got %v", panels)
+	}
+	if posted[0]["folderUid"] != "team" {
+		t.Errorf("Expected the dashboard to be saved in its folder, got %v", posted[0]["folderUid"])
+	}
+}
+
+func TestAddAnalyticsConflict(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	g.conflicts = 1
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := resultsByUid(results)["without"].Status; status != worker.StatusUpdated {
+		t.Errorf("Expected the dashboard to be updated after a conflict, got %s", status)
+	}
+	if len(g.posted) != 2 {
+		t.Errorf("Expected the dashboard to be saved twice, got %d", len(g.posted))
+	}
+	for _, posted := range g.posted {
+		if posted["overwrite"] != false {
+			t.Errorf("Expected the dashboard to be saved without overwrite, got %v", posted["overwrite"])
+		}
+	}
+}
+
+func TestAddAnalyticsGiveUp(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	g.conflicts = 100
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	without := resultsByUid(results)["without"]
+	if without.Status != worker.StatusConflict || without.Error == "" {
+		t.Errorf("Expected the dashboard to be given up on, got %+v", without)
+	}
+	if len(g.posted) != 3 {
+		t.Errorf("Expected 3 attempts to save the dashboard, got %d", len(g.posted))
+	}
+}
+
+func TestRemoveAnalytics(t *testing.T) {
+	server, g := newGrafana(t, map[string]string{
+		"with": `{"uid": "with", "title": "With", "version": 1, "panels": [
+			{"id": 1, "type": "macropower-analytics-panel"},
+			{"id": 2, "type": "graph"},
+			{"id": 3, "type": "row", "collapsed": true, "panels": [{"id": 4, "type": "macropower-analytics-panel"}]},
+			{"id": 5, "type": "macropower-analytics-panel"}
+		]}`,
+		"without": `{"uid": "without", "title": "Without", "version": 1, "panels": [{"id": 1, "type": "graph"}]}`,
+	})
+	api := worker.Client{GrafanaUrl: server.URL, Logger: logger}
+
+	results, err := api.RemoveAnalyticsFromDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byUid := resultsByUid(results)
+	if byUid["without"].Status != worker.StatusUnchanged {
+		t.Errorf("Expected the dashboard without a panel to be unchanged, got %+v", byUid["without"])
+	}
+
+	with := byUid["with"]
+	if with.Status != worker.StatusUpdated {
+		t.Fatalf("Expected the dashboard with panels to be updated, got %+v", with)
+	}
+	paths := []string{}
+	for _, op := range with.Diff {
+		paths = append(paths, op.Path)
+	}
+	if strings.Join(paths, " ") != "/dashboard/panels/2/panels/0 /dashboard/panels/3 /dashboard/panels/0" {
+		t.Errorf("Expected the panels to be removed in order, got %v", paths)
+	}
+
+	if len(g.posted) != 1 || !strings.Contains(g.posted[0]["message"].(string), "Remove") {
+		t.Fatalf("Expected the dashboard to be saved with a message, got %v", g.posted)
+	}
+	panels := g.dashboards["with"]["panels"].([]interface{})
+	if len(panels) != 2 || len(panels[1].(map[string]interface{})["panels"].([]interface{})) != 0 {
+		t.Errorf("Expected only the graph and the empty row to be left, got %v", panels)
+	}
+}
+
+func TestReconcileAnalytics(t *testing.T) {
+	server, g := newGrafana(t, map[string]string{
+		"drifted": `{"uid": "drifted", "title": "Drifted", "version": 1, "panels": [{"id": 2, "type": "macropower-analytics-panel", "options": {"analyticsOptions": {
+			"dashboard": "$__dashboard", "flatten": false, "heartbeatAlways": false, "heartbeatInterval": 30,
+			"postStart": true, "server": "http://old/write", "custom": "kept"
+		}}}]}`,
+		"empty":   `{"uid": "empty", "title": "Empty", "version": 1, "panels": [{"id": 1, "type": "macropower-analytics-panel"}]}`,
+		"partial": `{"uid": "partial", "title": "Partial", "version": 1, "panels": [{"id": 1, "type": "macropower-analytics-panel", "options": {"legend": "kept"}}]}`,
+	})
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger}
+
+	// Existing panels are left alone, unless options are reconciled.
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != worker.StatusUnchanged {
+			t.Errorf("Expected dashboards to be unchanged without reconciled options, got %+v", r)
+		}
+	}
+
+	api.Reconcile = []string{"heartbeatInterval", "postEnd", "postHeartbeat", "server"}
+	results, err = api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byUid := resultsByUid(results)
+
+	drifted := byUid["drifted"]
+	if drifted.Status != worker.StatusUpdated {
+		t.Fatalf("Expected the drifted dashboard to be updated, got %+v", drifted)
+	}
+	drift := []string{}
+	for _, d := range drifted.Drift {
+		drift = append(drift, d.Option)
+	}
+	if strings.Join(drift, " ") != "heartbeatInterval postEnd postHeartbeat server" {
+		t.Errorf("Expected the drifted options to be reported, got %v", drift)
+	}
+	if drifted.Diff[0].Op != "replace" || drifted.Diff[1].Op != "add" {
+		t.Errorf("Expected changed options to be replaced and missing options to be added, got %+v", drifted.Diff)
+	}
+
+	options := g.dashboards["drifted"]["panels"].([]interface{})[0].(map[string]interface{})["options"].(map[string]interface{})["analyticsOptions"].(map[string]interface{})
+	if options["server"] != "http://analytics/write" || options["custom"] != "kept" {
+		t.Errorf("Expected the server to be updated and other options kept, got %v", options)
+	}
+
+	empty := byUid["empty"]
+	if empty.Status != worker.StatusUpdated || len(empty.Diff) != 5 || empty.Diff[0].Path != "/dashboard/panels/0/options" || len(empty.Drift) != 4 {
+		t.Errorf("Expected the options to be added to the empty panel, got %+v", empty)
+	}
+
+	partial := byUid["partial"]
+	if partial.Status != worker.StatusUpdated || len(partial.Diff) != 5 || partial.Diff[0].Path != "/dashboard/panels/0/options/analyticsOptions" {
+		t.Errorf("Expected the analytics options to be added to the panel options, got %+v", partial)
+	}
+	options = g.dashboards["partial"]["panels"].([]interface{})[0].(map[string]interface{})["options"].(map[string]interface{})
+	if analyticsOptions, _ := options["analyticsOptions"].(map[string]interface{}); options["legend"] != "kept" || len(analyticsOptions) != 4 {
+		t.Errorf("Expected only the reconciled options to be added and other options kept, got %v", options)
+	}
+
+	results, err = api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != worker.StatusUnchanged {
+			t.Errorf("Expected reconciled dashboards to be unchanged, got %+v", r)
+		}
+	}
+}
+
+func TestAddAnalyticsTemplate(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	template, err := worker.ParsePanelTemplate([]byte(`{"title": "Usage", "type": "macropower-analytics-panel", "options": {"analyticsOptions": {"server": "$__analytics_url/write", "postEnd": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger, Template: template, Reconcile: []string{"postEnd", "server"}}
+
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byUid := resultsByUid(results)
+	if byUid["without"].Status != worker.StatusUpdated {
+		t.Errorf("Expected the panel to be added, got %+v", byUid["without"])
+	}
+	panel := g.dashboards["without"]["panels"].([]interface{})[0].(map[string]interface{})
+	if panel["title"] != "Usage" || panel["id"] != float64(5) {
+		t.Errorf("Expected the panel from the template, got %v", panel)
+	}
+
+	with := byUid["with"]
+	if len(with.Drift) != 1 || with.Drift[0].Option != "postEnd" {
+		t.Errorf("Expected only the drifted options to be reconciled, got %+v", with)
+	}
+}
+
+func TestCheckReconcile(t *testing.T) {
+	for _, c := range []struct {
+		analyticsUrl string
+		reconcile    []string
+		valid        bool
+	}{
+		{":8080", nil, true},
+		{":8080", []string{"postEnd"}, true},
+		{":8080", []string{"server"}, false},
+		{"http://analytics:8080", []string{"server"}, true},
+		{"http://analytics:8080", []string{"unknown"}, false},
+	} {
+		api := worker.Client{AnalyticsUrl: c.analyticsUrl, Logger: logger, Reconcile: c.reconcile}
+		err := api.CheckReconcile()
+		if (err == nil) != c.valid {
+			t.Errorf("Expected %v with %s to be valid: %v, got %v", c.reconcile, c.analyticsUrl, c.valid, err)
+		}
+	}
+}
+
+func TestAddAnalyticsSelector(t *testing.T) {
+	server, g := newGrafana(t, testDashboards)
+	selector, err := worker.ParseSelector(nil, []string{"uid=without"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := worker.Client{GrafanaUrl: server.URL, AnalyticsUrl: "http://analytics", Logger: logger, Selector: selector}
+
+	results, err := api.AddAnalyticsToDashboards(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Uid != "with" {
+		t.Errorf("Expected only the selected dashboard to be patched, got %+v", results)
+	}
+	if len(g.posted) != 0 {
+		t.Errorf("Expected no dashboards to be saved, got %d", len(g.posted))
+	}
+}